@@ -0,0 +1,73 @@
+package wcache
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wyy-go/wcache/persist"
+)
+
+// errNotLoadable the store can not share the cached response, it must be copied by Get
+var errNotLoadable = errors.New("cache not loadable")
+
+// loadCache load the response shared by an in-process store without decoding or copying,
+// it is immutable as Cache never modifies a response after setting it
+func loadCache(options *Options, key string) (*ResponseCache, error) {
+	loader, ok := options.store.(persist.Loader)
+	if !ok {
+		return nil, errNotLoadable
+	}
+	v, err := loader.Load(key)
+	if err != nil {
+		return nil, err
+	}
+	// e.g. restored from a snapshot, which is decoded by Get
+	respCache, ok := v.(*ResponseCache)
+	if !ok {
+		return nil, errNotLoadable
+	}
+	return respCache, nil
+}
+
+// getCache get the cache of key into respCache. if the store keeps the body apart, e.g. as a file,
+// and the response can be served as is, the opened body is returned to be streamed, otherwise it is loaded
+func getCache(options *Options, key string, respCache *ResponseCache) (io.ReadSeekCloser, error) {
+	opener, ok := options.store.(persist.BodyOpener)
+	if !ok {
+		return nil, options.store.Get(key, respCache)
+	}
+
+	body, err := opener.OpenBody(key, respCache)
+	if err != nil || body == nil {
+		return nil, err
+	}
+	if streamable(respCache) {
+		return body, nil
+	}
+	defer body.Close()
+	respCache.Data, err = ioutil.ReadAll(body)
+	return nil, err
+}
+
+// streamable report whether the body can be served by http.ServeContent, which answers 200, 206
+// or 304 with the body as is, so the status must be 200 and no content-coding is negotiated
+func streamable(respCache *ResponseCache) bool {
+	return respCache.Status == http.StatusOK && len(respCache.Variants) == 0 &&
+		respCache.Header.Get("Content-Encoding") == ""
+}
+
+// responseWithBody serve the body streamed from the store by http.ServeContent, which also
+// answers the range and conditional requests against the replayed ETag and Last-Modified
+func responseWithBody(c *gin.Context, options *Options, respCache *ResponseCache, body io.ReadSeekCloser) {
+	defer body.Close()
+
+	replayHeader(c.Writer.Header(), respCache.Header, options.headerPolicy)
+	modtime, _ := http.ParseTime(respCache.Header.Get("Last-Modified"))
+	http.ServeContent(c.Writer, c.Request, "", modtime, body)
+
+	// abort handler chain and return directly
+	c.Abort()
+}
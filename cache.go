@@ -1,12 +1,19 @@
 package wcache
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"net/url"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/sync/singleflight"
+	"github.com/wyy-go/wcache/persist"
 )
 
 // PageCachePrefix default page cache key prefix
@@ -14,50 +21,67 @@ var PageCachePrefix = "wcache.page.cache:"
 
 // Cache user must pass getCacheKey to describe the way to generate cache key
 func Cache(opts ...Option) gin.HandlerFunc {
-	options := &Options{
-		logger:                    NewDiscard(),
-		hitCacheCallback:          defaultHitCacheCallback,
-		shareSingleFlightCallback: defaultShareSingleFlightCallback,
-		group:                     new(singleflight.Group),
-		store:                     nil,
-		expire:                    10 * time.Minute,
-		handle:                    defaultHandle,
-		generateCacheKey:          GenerateCacheKeyByURI,
-		pool:                      NewPool(),
-		encode:                    JSONEncoding{},
-		rand:                      defaultRand,
-	}
-
-	for _, opt := range opts {
-		opt(options)
-	}
-
-	if options.store == nil {
-		panic("you must set a cache store!")
-	}
+	options := newOptions(opts...)
 
 	return func(c *gin.Context) {
+		method := c.Request.Method
+		if method != http.MethodHead && !options.methods[method] {
+			options.handle(c)
+			if options.invalidateOnUnsafeMethod && isSucceeded(c) {
+				invalidate(c, options)
+			}
+			return
+		}
+
 		cacheKey, shouldCache := options.generateCacheKey(c)
 		if !shouldCache {
 			options.handle(c)
 			return
 		}
 
-		// read cache first
-		respCache := options.pool.Get()
-		defer options.pool.Put(respCache)
-		respCache.encode = options.encode
-
-		err := options.store.Get(cacheKey, respCache)
+		// read cache first, the in-process stores share the cached response as it is
+		var body io.ReadSeekCloser
+		respCache, err := loadCache(options, cacheKey)
+		if err == errNotLoadable {
+			respCache = options.pool.Get()
+			defer options.pool.Put(respCache)
+			respCache.encode = options.encode
+			body, err = getCache(options, cacheKey, respCache)
+		}
 		if err == nil {
-			responseWithCache(c, options, respCache)
+			if body != nil {
+				responseWithBody(c, options, respCache, body)
+			} else {
+				responseWithCache(c, options, respCache)
+			}
 			options.hitCacheCallback(c)
+			// only the requests without body can be replayed for refresh
+			if options.refresher != nil && method == http.MethodGet && options.refresher.hit(options, cacheKey) {
+				refreshCache(c, options, cacheKey)
+			}
 			return
-		} else {
+		} else if errors.Is(err, ErrUnknownVersion) && options.unknownVersionPolicy == UnknownVersionBypass {
+			// leave the entry of the newer release as it is
+			options.handle(c)
+			return
+		} else if errors.Is(err, ErrCorrupt) {
+			// delete the corrupt key, so that it can not keep failing
+			if err := options.store.Delete(cacheKey); err != nil && !errors.Is(err, persist.ErrCacheMiss) {
+				options.logger.Errorf("delete corrupt cache key error: %s, cache key: %s", err, cacheKey)
+			}
+			options.corruptCallback(c, cacheKey, err)
+		} else if !errors.Is(err, persist.ErrCacheMiss) {
 			options.logger.Errorf("get cache error: %s, cache key: %s", err, cacheKey)
 		}
 
-		inFlight := false
+		// HEAD is answered from the GET entry only, it never fills the cache,
+		// otherwise a body-less response would poison the GET key
+		if method == http.MethodHead {
+			options.handle(c)
+			return
+		}
+
+		inFlight, fromStore := false, false
 		rawRespCache, _, shared := options.group.Do(cacheKey, func() (interface{}, error) {
 			if options.singleFlightForgetTimeout > 0 {
 				forgetTimer := time.AfterFunc(options.singleFlightForgetTimeout, func() {
@@ -66,31 +90,60 @@ func Cache(opts ...Option) gin.HandlerFunc {
 				defer forgetTimer.Stop()
 			}
 
-			// use responseCacheWriter in order to record the response
-			cacheWriter := &responseCacheWriter{ResponseWriter: c.Writer}
-			c.Writer = cacheWriter
-			options.handle(c)
-
+			var respCache *ResponseCache
+			respCache, fromStore = renderLocked(c, options, cacheKey, true)
 			inFlight = true
-			respCache := getCacheFromWriter(cacheWriter, options.encode)
-
-			// only cache 2xx response
-			if !c.IsAborted() && cacheWriter.Status() < 300 && cacheWriter.Status() >= 200 {
-				if err := options.store.Set(cacheKey, respCache, options.expire+options.rand()); err != nil {
-					options.logger.Errorf("set cache key error: %s, cache key: %s", err, cacheKey)
-				}
+			if respCache == nil {
+				return nil, nil
 			}
-
 			return respCache, nil
 		})
 
-		if !inFlight && shared {
+		if inFlight && fromStore {
+			// rendered by another instance holding the distributed lock
+			responseWithCache(c, options, rawRespCache.(*ResponseCache))
+			options.hitCacheCallback(c)
+		} else if !inFlight && shared {
+			if rawRespCache == nil {
+				options.handle(c)
+				return
+			}
 			responseWithCache(c, options, rawRespCache.(*ResponseCache))
 			options.shareSingleFlightCallback(c)
 		}
 	}
 }
 
+// renderCache render the response by the handler while recording it, and set it to the store
+// if it is a 2xx one, fenced by the lease if any, return nil if the response can not be cached
+func renderCache(c *gin.Context, options *Options, cacheKey string, lease persist.Lease) *ResponseCache {
+	// use responseCacheWriter in order to record the response
+	cacheWriter := &responseCacheWriter{ResponseWriter: c.Writer, maxBodySize: options.maxBodySize}
+	c.Writer = cacheWriter
+	options.handle(c)
+
+	// the body has not been recorded, so it can neither be cached nor shared
+	if !cacheWriter.cacheable() {
+		return nil
+	}
+	respCache := getCacheFromWriter(cacheWriter, options.encode)
+	compressResponse(options, respCache)
+
+	// only cache 2xx response
+	if !c.IsAborted() && cacheWriter.Status() < 300 && cacheWriter.Status() >= 200 {
+		expire := options.expire + options.rand()
+		if err := setCache(options, cacheKey, respCache, expire, lease); err != nil {
+			options.logger.Errorf("set cache key error: %s, cache key: %s", err, cacheKey)
+		} else {
+			tagCacheKey(c, options, cacheKey, expire)
+			if options.refresher != nil {
+				options.refresher.setExpire(cacheKey, expire)
+			}
+		}
+	}
+	return respCache
+}
+
 // CacheByRequestURI a shortcut function for caching response by uri
 func CacheByRequestURI(opts ...Option) gin.HandlerFunc {
 	return Cache(opts...)
@@ -118,3 +171,69 @@ func GenerateCacheKeyByURI(c *gin.Context) (string, bool) {
 func GenerateCacheKeyByPath(c *gin.Context) (string, bool) {
 	return CacheKeyWithPrefix(PageCachePrefix, url.QueryEscape(c.Request.URL.Path)), true
 }
+
+// DefaultMaxKeyBodySize the default limit of the request body read by GenerateCacheKeyByJSONBody
+const DefaultMaxKeyBodySize int64 = 64 << 10
+
+// GenerateCacheKeyByJSONBody return a GenerateCacheKey for requests with JSON body, such as
+// GraphQL or search APIs served by POST. the body is canonicalized with sorted keys, only the
+// given top-level fields are kept if any, e.g. "query", "variables" and "operationName",
+// and the hash of it is appended to the request uri. the body is restored for the handler,
+// requests with a body larger than maxBodySize or not a valid JSON will not be cached.
+// remember to enable the method with WithCacheableMethods.
+func GenerateCacheKeyByJSONBody(maxBodySize int64, fields ...string) GenerateCacheKey {
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxKeyBodySize
+	}
+
+	return func(c *gin.Context) (string, bool) {
+		var body []byte
+		if c.Request.Body != nil && c.Request.Body != http.NoBody {
+			var err error
+			body, err = ioutil.ReadAll(io.LimitReader(c.Request.Body, maxBodySize+1))
+			c.Request.Body = &restoredBody{io.MultiReader(bytes.NewReader(body), c.Request.Body), c.Request.Body}
+			if err != nil || int64(len(body)) > maxBodySize {
+				return "", false
+			}
+		}
+
+		canonical, err := canonicalJSON(body, fields)
+		if err != nil {
+			return "", false
+		}
+		d := sha1.Sum(canonical)
+		return CacheKeyWithPrefix(PageCachePrefix, url.QueryEscape(c.Request.RequestURI)+":"+hex.EncodeToString(d[:])), true
+	}
+}
+
+// canonicalJSON re-encode the JSON with sorted keys, and keep the given top-level fields only
+func canonicalJSON(data []byte, fields []string) ([]byte, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	if m, ok := v.(map[string]interface{}); ok && len(fields) > 0 {
+		selected := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			if fv, ok := m[field]; ok {
+				selected[field] = fv
+			}
+		}
+		v = selected
+	}
+	// encoding/json sorts the map keys
+	return json.Marshal(v)
+}
+
+// restoredBody replay the consumed part of the body, then the rest
+type restoredBody struct {
+	io.Reader
+	io.Closer
+}
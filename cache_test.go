@@ -1,20 +1,32 @@
 package wcache
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/require"
 	"github.com/wyy-go/wcache/persist"
+	"github.com/wyy-go/wcache/persist/fs"
 	"github.com/wyy-go/wcache/persist/memory"
 	redisStore "github.com/wyy-go/wcache/persist/redis"
 	"golang.org/x/sync/singleflight"
+	"hash/crc32"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -60,7 +72,11 @@ var newStore = func(defaultExpiration time.Duration) persist.CacheStore {
 }
 
 func performRequest(target string, router *gin.Engine) *httptest.ResponseRecorder {
-	r := httptest.NewRequest(http.MethodGet, target, nil)
+	return performRequestWithMethod(http.MethodGet, target, router)
+}
+
+func performRequestWithMethod(method, target string, router *gin.Engine) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, r)
 	return w
@@ -92,6 +108,77 @@ func TestCache(t *testing.T) {
 	assert.Equal(t, w1.Body.String(), w2.Body.String())
 }
 
+func TestCacheShardedStore(t *testing.T) {
+	store := memory.NewShardedStore(time.Second*60, 0)
+	defer store.Close()
+	r := gin.New()
+	r.GET("/cache/sharded",
+		Cache(
+			WithCacheStore(store),
+			WithHandle(func(c *gin.Context) {
+				c.Header("X-Id", generateID())
+				c.String(http.StatusOK, generateID())
+			}),
+		),
+	)
+
+	w1 := performRequest("/cache/sharded", r)
+	w2 := performRequest("/cache/sharded", r)
+
+	assert.Equal(t, http.StatusOK, w2.Code)
+	assert.Equal(t, w1.Body.String(), w2.Body.String())
+	assert.Equal(t, w1.Header().Get("X-Id"), w2.Header().Get("X-Id"))
+}
+
+func TestCacheSharedResponse(t *testing.T) {
+	store := memory.NewShardedStore(time.Second*60, 0)
+	defer store.Close()
+
+	r := gin.New()
+	// a middleware changing the response after the cache handler
+	r.Use(func(c *gin.Context) {
+		c.Next()
+		c.Writer.Header().Add("Link", "</changed>")
+		if values := c.Writer.Header()["X-Id"]; len(values) > 0 {
+			values[0] = "changed"
+		}
+	})
+	r.GET("/cache/shared",
+		Cache(
+			WithCacheStore(store),
+			WithHandle(func(c *gin.Context) {
+				c.Header("X-Id", generateID())
+				c.Header("Link", "</a>")
+				c.String(http.StatusOK, generateID())
+			}),
+		),
+	)
+
+	w1 := performRequest("/cache/shared", r)
+	cached, err := loadCache(&Options{store: store}, CacheKeyWithPrefix(PageCachePrefix, url.QueryEscape("/cache/shared")))
+	require.NoError(t, err)
+	id := cached.Header.Get("X-Id")
+	assert.Equal(t, []string{"</a>"}, cached.Header["Link"])
+
+	for i := 0; i < 2; i++ {
+		w := performRequest("/cache/shared", r)
+		assert.Equal(t, w1.Body.String(), w.Body.String())
+		assert.Equal(t, []string{"</a>", "</changed>"}, w.Header()["Link"])
+	}
+	// the shared response is never changed
+	assert.Equal(t, id, cached.Header.Get("X-Id"))
+	assert.Equal(t, []string{"</a>"}, cached.Header["Link"])
+	assert.Equal(t, w1.Body.String(), string(cached.Data))
+
+	// the data copied from a store is never decoded into after put back to the pool
+	pool := NewPool()
+	respCache := pool.Get()
+	require.True(t, respCache.CopyFrom(cached))
+	pool.Put(respCache)
+	assert.Nil(t, respCache.Data)
+	assert.Equal(t, w1.Body.String(), string(cached.Data))
+}
+
 func TestCacheNoNeedCache(t *testing.T) {
 	store := newStore(time.Second * 60)
 
@@ -332,6 +419,383 @@ func TestCacheWithRequestURI(t *testing.T) {
 	assert.NotEqual(t, w2.Body.String(), w3.Body.String())
 }
 
+func TestCacheHeadFromGet(t *testing.T) {
+	store := newStore(time.Second * 60)
+
+	handle := Cache(
+		WithCacheStore(store),
+		WithExpire(time.Second*3),
+		WithHandle(func(c *gin.Context) {
+			c.Header("X-Id", generateID())
+			c.String(http.StatusOK, generateID())
+		}),
+	)
+	r := gin.New()
+	r.GET("/cache/head", handle)
+	r.HEAD("/cache/head", handle)
+
+	// HEAD miss must not fill the GET entry
+	w1 := performRequestWithMethod(http.MethodHead, "/cache/head", r)
+	w2 := performRequest("/cache/head", r)
+	assert.Equal(t, http.StatusOK, w1.Code)
+	assert.NotEqual(t, w1.Header().Get("X-Id"), w2.Header().Get("X-Id"))
+	assert.NotEmpty(t, w2.Body.String())
+
+	w3 := performRequestWithMethod(http.MethodHead, "/cache/head", r)
+	assert.Equal(t, http.StatusOK, w3.Code)
+	assert.Equal(t, w2.Header().Get("X-Id"), w3.Header().Get("X-Id"))
+	assert.Empty(t, w3.Body.String())
+}
+
+func TestCacheUnsafeMethod(t *testing.T) {
+	store := newStore(time.Second * 60)
+
+	handle := Cache(
+		WithCacheStore(store),
+		WithExpire(time.Second*3),
+		WithInvalidateOnUnsafeMethod(true),
+		WithHandle(func(c *gin.Context) {
+			c.String(http.StatusOK, generateID())
+		}),
+	)
+	r := gin.New()
+	r.GET("/cache/item", handle)
+	r.POST("/cache/item", handle)
+
+	w1 := performRequest("/cache/item", r)
+	w2 := performRequestWithMethod(http.MethodPost, "/cache/item", r)
+	w3 := performRequestWithMethod(http.MethodPost, "/cache/item", r)
+	w4 := performRequest("/cache/item", r)
+	w5 := performRequest("/cache/item", r)
+
+	assert.NotEqual(t, w1.Body.String(), w2.Body.String())
+	assert.NotEqual(t, w2.Body.String(), w3.Body.String())
+	assert.NotEqual(t, w1.Body.String(), w4.Body.String())
+	assert.Equal(t, w4.Body.String(), w5.Body.String())
+}
+
+func TestInvalidateOn(t *testing.T) {
+	store := newStore(time.Second * 60)
+
+	r := gin.New()
+	handle := func(c *gin.Context) {
+		c.String(http.StatusOK, generateID())
+	}
+	r.GET("/items/:id", Cache(WithCacheStore(store), WithHandle(handle)))
+	r.GET("/items", Cache(WithCacheStore(store), WithHandle(handle)))
+	r.PUT("/items/:id",
+		InvalidateOn(
+			WithCacheStore(store),
+			WithInvalidateURIs(func(c *gin.Context) []string {
+				return []string{"/items/" + c.Param("id"), "/items"}
+			}),
+		),
+		func(c *gin.Context) {
+			c.Status(http.StatusNoContent)
+		},
+	)
+	r.DELETE("/items/:id",
+		InvalidateOn(WithCacheStore(store)),
+		func(c *gin.Context) {
+			c.Status(http.StatusForbidden)
+		},
+	)
+
+	w1 := performRequest("/items/5", r)
+	w2 := performRequest("/items", r)
+	w3 := performRequest("/items/6", r)
+
+	// failed request keeps the cache
+	performRequestWithMethod(http.MethodDelete, "/items/5", r)
+	assert.Equal(t, w1.Body.String(), performRequest("/items/5", r).Body.String())
+
+	w := performRequestWithMethod(http.MethodPut, "/items/5", r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.NotEqual(t, w1.Body.String(), performRequest("/items/5", r).Body.String())
+	assert.NotEqual(t, w2.Body.String(), performRequest("/items", r).Body.String())
+	assert.Equal(t, w3.Body.String(), performRequest("/items/6", r).Body.String())
+}
+
+func TestInvalidateOnTagsAndPrefixes(t *testing.T) {
+	store := newStore(time.Second * 60)
+
+	r := gin.New()
+	r.GET("/users/:id/*path",
+		Cache(
+			WithCacheStore(store),
+			WithGenerateCacheKey(GenerateCacheKeyByPath),
+			WithTags(func(c *gin.Context) []string {
+				return []string{"user:" + c.Param("id")}
+			}),
+			WithHandle(func(c *gin.Context) {
+				c.String(http.StatusOK, generateID())
+			}),
+		),
+	)
+	r.POST("/users/:id",
+		InvalidateOn(
+			WithCacheStore(store),
+			WithInvalidateTags(func(c *gin.Context) []string {
+				return []string{"user:" + c.Param("id")}
+			}),
+		),
+	)
+	r.DELETE("/users/:id",
+		InvalidateOn(
+			WithCacheStore(store),
+			WithInvalidatePrefixes(func(c *gin.Context) []string {
+				return []string{PageCachePrefix}
+			}),
+		),
+	)
+
+	w1 := performRequest("/users/1/profile", r)
+	w2 := performRequest("/users/1/posts", r)
+	w3 := performRequest("/users/2/profile", r)
+
+	performRequestWithMethod(http.MethodPost, "/users/1", r)
+	assert.NotEqual(t, w1.Body.String(), performRequest("/users/1/profile", r).Body.String())
+	assert.NotEqual(t, w2.Body.String(), performRequest("/users/1/posts", r).Body.String())
+	assert.Equal(t, w3.Body.String(), performRequest("/users/2/profile", r).Body.String())
+
+	performRequestWithMethod(http.MethodDelete, "/users/2", r)
+	assert.NotEqual(t, w3.Body.String(), performRequest("/users/2/profile", r).Body.String())
+}
+
+func TestCacheByJSONBody(t *testing.T) {
+	store := newStore(time.Second * 60)
+
+	r := gin.New()
+	r.POST("/graphql",
+		Cache(
+			WithCacheStore(store),
+			WithCacheableMethods(http.MethodPost),
+			WithGenerateCacheKey(GenerateCacheKeyByJSONBody(64, "query", "variables")),
+			WithHandle(func(c *gin.Context) {
+				var body map[string]interface{}
+				if err := c.ShouldBindJSON(&body); err != nil {
+					c.String(http.StatusBadRequest, err.Error())
+					return
+				}
+				c.String(http.StatusOK, fmt.Sprintf("%v:%s", body["query"], generateID()))
+			}),
+		),
+	)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w1 := post(`{"query":"a","variables":{"x":1,"y":2},"extensions":1}`)
+	w2 := post(`{"variables":{"y":2,"x":1},"query":"a","extensions":2}`)
+	w3 := post(`{"query":"b","variables":{"x":1,"y":2}}`)
+	assert.Equal(t, http.StatusOK, w1.Code)
+	assert.True(t, strings.HasPrefix(w1.Body.String(), "a:"))
+	assert.Equal(t, w1.Body.String(), w2.Body.String())
+	assert.NotEqual(t, w1.Body.String(), w3.Body.String())
+
+	// the body exceeds the limit, it is not cached but still readable
+	long := `{"query":"` + strings.Repeat("c", 64) + `"}`
+	w4 := post(long)
+	w5 := post(long)
+	assert.Equal(t, http.StatusOK, w4.Code)
+	assert.True(t, strings.HasPrefix(w4.Body.String(), strings.Repeat("c", 64)+":"))
+	assert.NotEqual(t, w4.Body.String(), w5.Body.String())
+}
+
+// binaryStore keep the values encoded like the remote stores do
+type binaryStore struct {
+	*memory.MemoryStore
+}
+
+func newBinaryStore(expire time.Duration) *binaryStore {
+	return &binaryStore{memory.NewMemoryStore(expire)}
+}
+
+func (s *binaryStore) Set(key string, value interface{}, expire time.Duration) error {
+	data, err := value.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return s.MemoryStore.Set(key, data, expire)
+}
+
+func (s *binaryStore) Get(key string, value interface{}) error {
+	var data []byte
+	if err := s.MemoryStore.Get(key, &data); err != nil {
+		return err
+	}
+	return value.(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+}
+
+func TestCacheCorrupt(t *testing.T) {
+	store := newBinaryStore(time.Second * 60)
+
+	var corruptKeys []string
+	var corruptErrs []error
+	r := gin.New()
+	r.GET("/cache/corrupt",
+		Cache(
+			WithCacheStore(store),
+			WithEncoding(BinaryEncoding{}),
+			WithOnCorrupt(func(c *gin.Context, key string, err error) {
+				corruptKeys = append(corruptKeys, key)
+				corruptErrs = append(corruptErrs, err)
+			}),
+			WithHandle(func(c *gin.Context) {
+				c.String(http.StatusOK, generateID())
+			}),
+		),
+	)
+
+	key, _ := GenerateCacheKeyByURI(&gin.Context{Request: httptest.NewRequest(http.MethodGet, "/cache/corrupt", nil)})
+	corrupt := func(f func(data []byte) []byte) {
+		var data []byte
+		require.NoError(t, store.MemoryStore.Get(key, &data))
+		require.NoError(t, store.MemoryStore.Set(key, f(append([]byte(nil), data...)), time.Minute))
+	}
+
+	w1 := performRequest("/cache/corrupt", r)
+	w2 := performRequest("/cache/corrupt", r)
+	assert.Equal(t, w1.Body.String(), w2.Body.String())
+	assert.Empty(t, corruptKeys)
+
+	// flipped bit
+	corrupt(func(data []byte) []byte {
+		data[len(data)-1] ^= 1
+		return data
+	})
+	w3 := performRequest("/cache/corrupt", r)
+	assert.NotEqual(t, w1.Body.String(), w3.Body.String())
+	assert.Equal(t, []string{key}, corruptKeys)
+	assert.True(t, errors.Is(corruptErrs[0], ErrCorrupt))
+	assert.Equal(t, w3.Body.String(), performRequest("/cache/corrupt", r).Body.String())
+
+	// truncated
+	corrupt(func(data []byte) []byte {
+		return data[:5]
+	})
+	w4 := performRequest("/cache/corrupt", r)
+	assert.NotEqual(t, w3.Body.String(), w4.Body.String())
+	assert.Len(t, corruptKeys, 2)
+
+	// legacy data without frame which can not be decoded
+	corrupt(func(data []byte) []byte {
+		return []byte(`{"Status":200,`)
+	})
+	w5 := performRequest("/cache/corrupt", r)
+	assert.NotEqual(t, w4.Body.String(), w5.Body.String())
+	assert.Len(t, corruptKeys, 3)
+	assert.Equal(t, w5.Body.String(), performRequest("/cache/corrupt", r).Body.String())
+}
+
+func TestResponseCacheFrame(t *testing.T) {
+	want := ResponseCache{Status: 200, Header: http.Header{}, Data: []byte("foo"), encode: JSONEncoding{}}
+
+	data, err := want.MarshalBinary()
+	require.NoError(t, err)
+	require.Equal(t, frameMagic[:], data[:2])
+
+	got := ResponseCache{encode: JSONEncoding{}}
+	require.NoError(t, got.UnmarshalBinary(data))
+	require.Equal(t, want, got)
+
+	// legacy data without frame
+	legacy, err := JSONEncoding{}.Marshal(want)
+	require.NoError(t, err)
+	got = ResponseCache{encode: JSONEncoding{}}
+	require.NoError(t, got.UnmarshalBinary(legacy))
+	require.Equal(t, want, got)
+
+	// frame version 1 without schema version
+	v1 := append([]byte{'w', 'c', 1}, data[4:]...)
+	binary.BigEndian.PutUint32(v1[3:], crc32.Checksum(v1[7:], crcTable))
+	got = ResponseCache{encode: JSONEncoding{}}
+	require.NoError(t, got.UnmarshalBinary(v1))
+	require.Equal(t, want, got)
+
+	for _, bad := range [][]byte{data[:4], v1[:5], append([]byte{'w', 'c', 0}, data[3:]...), append(data[:len(data):len(data)], ' ')} {
+		err = got.UnmarshalBinary(bad)
+		require.True(t, errors.Is(err, ErrCorrupt))
+		require.True(t, errors.Is(err, persist.ErrCacheMiss))
+	}
+}
+
+func TestResponseCacheVersion(t *testing.T) {
+	want := ResponseCache{Status: 200, Header: http.Header{}, Data: []byte("foo"), encode: JSONEncoding{}}
+
+	payload, err := JSONEncoding{}.Marshal(want)
+	require.NoError(t, err)
+
+	// a future schema version is unknown, but not corrupt
+	for _, data := range [][]byte{
+		marshalFrame(payload, ResponseCacheVersion+1),
+		append([]byte{'w', 'c', frameVersion + 1}, payload...),
+	} {
+		got := ResponseCache{encode: JSONEncoding{}}
+		err = got.UnmarshalBinary(data)
+		require.True(t, errors.Is(err, ErrUnknownVersion))
+		require.True(t, errors.Is(err, persist.ErrCacheMiss))
+		require.False(t, errors.Is(err, ErrCorrupt))
+	}
+
+	// upgrade the legacy data by the registered upgrader
+	RegisterUpgrader(0, func(payload []byte, encode Encoding) ([]byte, error) {
+		var legacy map[string]interface{}
+		if err := encode.Unmarshal(payload, &legacy); err != nil {
+			return nil, err
+		}
+		legacy["Data"] = legacy["Body"]
+		return encode.Marshal(legacy)
+	})
+	defer RegisterUpgrader(0, func(payload []byte, _ Encoding) ([]byte, error) { return payload, nil })
+
+	got := ResponseCache{encode: JSONEncoding{}}
+	require.NoError(t, got.UnmarshalBinary([]byte(`{"Status":200,"Header":{},"Body":"Zm9v"}`)))
+	require.Equal(t, want, got)
+
+	err = got.UnmarshalBinary([]byte(`{"Status":200,`))
+	require.True(t, errors.Is(err, ErrCorrupt))
+}
+
+func TestCacheUnknownVersion(t *testing.T) {
+	for _, policy := range []UnknownVersionPolicy{UnknownVersionMiss, UnknownVersionBypass} {
+		store := newBinaryStore(time.Second * 60)
+
+		r := gin.New()
+		r.GET("/cache/version",
+			Cache(
+				WithCacheStore(store),
+				WithUnknownVersionPolicy(policy),
+				WithHandle(func(c *gin.Context) {
+					c.String(http.StatusOK, generateID())
+				}),
+			),
+		)
+
+		key, _ := GenerateCacheKeyByURI(&gin.Context{Request: httptest.NewRequest(http.MethodGet, "/cache/version", nil)})
+		future := marshalFrame([]byte("from the future"), ResponseCacheVersion+1)
+		require.NoError(t, store.MemoryStore.Set(key, future, time.Minute))
+
+		w1 := performRequest("/cache/version", r)
+		w2 := performRequest("/cache/version", r)
+		assert.Equal(t, http.StatusOK, w1.Code)
+
+		var data []byte
+		require.NoError(t, store.MemoryStore.Get(key, &data))
+		if policy == UnknownVersionBypass {
+			assert.NotEqual(t, w1.Body.String(), w2.Body.String())
+			assert.Equal(t, future, data)
+		} else {
+			assert.Equal(t, w1.Body.String(), w2.Body.String())
+			assert.NotEqual(t, future, data)
+		}
+	}
+}
+
 type memoryDelayStore struct {
 	*memory.MemoryStore
 }
@@ -385,7 +849,7 @@ func TestBodyWrite(t *testing.T) {
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
 
-	writer := &responseCacheWriter{c.Writer, bytes.Buffer{}}
+	writer := &responseCacheWriter{ResponseWriter: c.Writer}
 	c.Writer = writer
 
 	c.Writer.WriteHeader(http.StatusNoContent)
@@ -402,6 +866,389 @@ func TestBodyWrite(t *testing.T) {
 	assert.True(t, c.Writer.Written())
 }
 
+func TestBodyWriteExceedMaxBodySize(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	writer := &responseCacheWriter{ResponseWriter: c.Writer, maxBodySize: 4}
+	c.Writer = writer
+
+	c.Writer.WriteString("foo") // nolint: errcheck
+	assert.Equal(t, "foo", writer.body.String())
+	assert.False(t, writer.uncacheable)
+	c.Writer.WriteString("bar") // nolint: errcheck
+	assert.Equal(t, "foobar", w.Body.String())
+	assert.Equal(t, 0, writer.body.Len())
+	assert.True(t, writer.uncacheable)
+	c.Writer.Write([]byte("b")) // nolint: errcheck
+	assert.Equal(t, "foobarb", w.Body.String())
+	assert.Equal(t, 0, writer.body.Len())
+}
+
+func TestCacheMaxBodySize(t *testing.T) {
+	store := newStore(time.Second * 60)
+
+	r := gin.New()
+	r.GET("/cache/large",
+		Cache(
+			WithCacheStore(store),
+			WithMaxBodySize(32),
+			WithHandle(func(c *gin.Context) {
+				c.String(http.StatusOK, strings.Repeat(c.Query("n"), 4)+generateID())
+			}),
+		),
+	)
+
+	w1 := performRequest("/cache/large?n=1", r)
+	w2 := performRequest("/cache/large?n=1", r)
+	assert.Equal(t, w1.Body.String(), w2.Body.String())
+
+	w3 := performRequest("/cache/large?n=1234567890", r)
+	w4 := performRequest("/cache/large?n=1234567890", r)
+	assert.Equal(t, http.StatusOK, w3.Code)
+	assert.True(t, strings.HasPrefix(w3.Body.String(), strings.Repeat("1234567890", 4)))
+	assert.NotEqual(t, w3.Body.String(), w4.Body.String())
+}
+
+func TestBodyWriteStreaming(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	writer := &responseCacheWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+
+	c.Writer.WriteString("foo") // nolint: errcheck
+	assert.True(t, writer.cacheable())
+	c.Writer.Flush()
+	assert.True(t, w.Flushed)
+	assert.False(t, writer.cacheable())
+	c.Writer.WriteString("bar") // nolint: errcheck
+	assert.Equal(t, "foobar", w.Body.String())
+	assert.Equal(t, 0, writer.body.Len())
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	writer = &responseCacheWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Writer.WriteString("data: foo\n\n") // nolint: errcheck
+	assert.False(t, writer.cacheable())
+	assert.Equal(t, 0, writer.body.Len())
+}
+
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func TestBodyWriteHijack(t *testing.T) {
+	w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	c, _ := gin.CreateTestContext(w)
+
+	writer := &responseCacheWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+
+	_, _, err := c.Writer.Hijack()
+	require.NoError(t, err)
+	assert.True(t, w.hijacked)
+	assert.False(t, writer.cacheable())
+}
+
+func TestCacheServerSentEvents(t *testing.T) {
+	store := newStore(time.Second * 60)
+
+	r := gin.New()
+	r.GET("/cache/sse",
+		Cache(
+			WithCacheStore(store),
+			WithHandle(func(c *gin.Context) {
+				c.SSEvent("message", generateID())
+			}),
+		),
+	)
+
+	w1 := performRequest("/cache/sse", r)
+	w2 := performRequest("/cache/sse", r)
+	assert.Equal(t, http.StatusOK, w1.Code)
+	assert.Equal(t, "text/event-stream", w1.Header().Get("Content-Type"))
+	assert.NotEqual(t, w1.Body.String(), w2.Body.String())
+}
+
+func TestResponseWithCacheHeader(t *testing.T) {
+	cached := &ResponseCache{
+		Status: http.StatusCreated,
+		Header: http.Header{
+			"Link":              {"</a>; rel=preload", "</b>; rel=preload"},
+			"Vary":              {"Accept", "Accept-Encoding"},
+			"X-Cached":          {"cached"},
+			"Connection":        {"X-Hop"},
+			"X-Hop":             {"hop"},
+			"Keep-Alive":        {"timeout=5"},
+			"Transfer-Encoding": {"chunked"},
+		},
+		Data: []byte("foo"),
+	}
+
+	tests := []struct {
+		policy HeaderPolicy
+		want   http.Header
+	}{
+		{HeaderPolicyOverwrite, http.Header{"Vary": {"Accept", "Accept-Encoding"}, "X-Cached": {"cached"}}},
+		{HeaderPolicyKeep, http.Header{"Vary": {"Origin"}, "X-Cached": {"existing"}}},
+		{HeaderPolicyAppend, http.Header{"Vary": {"Origin", "Accept", "Accept-Encoding"}, "X-Cached": {"existing", "cached"}}},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		c.Header("Vary", "Origin")
+		c.Header("X-Cached", "existing")
+
+		responseWithCache(c, &Options{logger: NewDiscard(), headerPolicy: tt.policy}, cached)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, "foo", w.Body.String())
+		assert.Equal(t, []string{"</a>; rel=preload", "</b>; rel=preload"}, w.Header()["Link"])
+		assert.Equal(t, tt.want["Vary"], w.Header()["Vary"])
+		assert.Equal(t, tt.want["X-Cached"], w.Header()["X-Cached"])
+		for _, key := range []string{"Connection", "X-Hop", "Keep-Alive", "Transfer-Encoding"} {
+			assert.Empty(t, w.Header().Get(key))
+		}
+		assert.True(t, c.IsAborted())
+	}
+
+	// the replayed values must not share memory with the cache
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	responseWithCache(c, &Options{logger: NewDiscard()}, cached)
+	w.Header()["Link"][0] = "changed"
+	assert.Equal(t, "</a>; rel=preload", cached.Header["Link"][0])
+}
+
+func TestCacheMultiValueHeader(t *testing.T) {
+	store := newStore(time.Second * 60)
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Header("X-Request-Id", generateID())
+	})
+	r.GET("/cache/header",
+		Cache(
+			WithCacheStore(store),
+			WithHeaderPolicy(HeaderPolicyKeep),
+			WithHandle(func(c *gin.Context) {
+				c.Writer.Header().Add("Link", "</a>; rel=preload")
+				c.Writer.Header().Add("Link", "</b>; rel=preload")
+				c.String(http.StatusOK, generateID())
+			}),
+		),
+	)
+
+	w1 := performRequest("/cache/header", r)
+	w2 := performRequest("/cache/header", r)
+	assert.Equal(t, w1.Body.String(), w2.Body.String())
+	assert.Equal(t, []string{"</a>; rel=preload", "</b>; rel=preload"}, w2.Header()["Link"])
+	assert.NotEqual(t, w1.Header().Get("X-Request-Id"), w2.Header().Get("X-Request-Id"))
+}
+
+func TestCacheFileStore(t *testing.T) {
+	store, err := fs.NewFileStore(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+
+	handle := Cache(
+		WithCacheStore(store),
+		WithHandle(func(c *gin.Context) {
+			c.Header("ETag", `"v1"`)
+			c.String(http.StatusOK, "hello "+generateID())
+		}),
+	)
+	r := gin.New()
+	r.GET("/cache/file", handle)
+	r.HEAD("/cache/file", handle)
+	r.GET("/cache/file/gzip",
+		Cache(
+			WithCacheStore(store),
+			WithCompressors(GzipCompressor{}),
+			WithHandle(func(c *gin.Context) {
+				c.String(http.StatusOK, "hello "+generateID())
+			}),
+		),
+	)
+
+	request := func(method, target string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w1 := request(http.MethodGet, "/cache/file", nil)
+	w2 := request(http.MethodGet, "/cache/file", nil)
+	assert.Equal(t, http.StatusOK, w2.Code)
+	assert.Equal(t, w1.Body.String(), w2.Body.String())
+	assert.Equal(t, `"v1"`, w2.Header().Get("ETag"))
+
+	// the hit is served by http.ServeContent from the body file
+	w3 := request(http.MethodGet, "/cache/file", map[string]string{"Range": "bytes=0-4"})
+	assert.Equal(t, http.StatusPartialContent, w3.Code)
+	assert.Equal(t, "hello", w3.Body.String())
+
+	w4 := request(http.MethodGet, "/cache/file", map[string]string{"If-None-Match": `"v1"`})
+	assert.Equal(t, http.StatusNotModified, w4.Code)
+	assert.Empty(t, w4.Body.String())
+
+	w5 := request(http.MethodHead, "/cache/file", nil)
+	assert.Equal(t, http.StatusOK, w5.Code)
+	assert.Empty(t, w5.Body.String())
+
+	// the negotiated content-coding is served from memory
+	w6 := request(http.MethodGet, "/cache/file/gzip", nil)
+	w7 := request(http.MethodGet, "/cache/file/gzip", nil)
+	assert.Empty(t, w7.Header().Get("Content-Encoding"))
+	assert.Equal(t, w6.Body.String(), w7.Body.String())
+
+	w8 := request(http.MethodGet, "/cache/file/gzip", map[string]string{"Accept-Encoding": "gzip"})
+	assert.Equal(t, "gzip", w8.Header().Get("Content-Encoding"))
+	data, err := GzipCompressor{}.Decompress(w8.Body.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, w6.Body.String(), string(data))
+}
+
+func TestCacheMemorySnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	newRouter := func(store persist.CacheStore) *gin.Engine {
+		r := gin.New()
+		r.GET("/cache/snapshot",
+			Cache(
+				WithCacheStore(store),
+				WithEncoding(MsgPackEncoding{}),
+				WithHandle(func(c *gin.Context) {
+					c.Header("X-Id", generateID())
+					c.String(http.StatusOK, generateID())
+				}),
+			),
+		)
+		return r
+	}
+
+	store := memory.NewMemoryStore(time.Minute, memory.WithSnapshotFile(path))
+	w1 := performRequest("/cache/snapshot", newRouter(store))
+	require.NoError(t, store.Close())
+
+	// the restarted store serves the response cached before
+	store = memory.NewMemoryStore(time.Minute, memory.WithSnapshotFile(path))
+	defer store.Close()
+	w2 := performRequest("/cache/snapshot", newRouter(store))
+	assert.Equal(t, w1.Body.String(), w2.Body.String())
+	assert.Equal(t, w1.Header().Get("X-Id"), w2.Header().Get("X-Id"))
+}
+
+func TestResponseCacheSplitBody(t *testing.T) {
+	respCache := &ResponseCache{
+		Status: http.StatusOK,
+		Header: http.Header{"Content-Type": {"text/plain"}},
+		Data:   []byte("hello"),
+		encode: JSONEncoding{},
+	}
+	head, body, err := respCache.SplitBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.NotContains(t, string(head), "aGVsbG8")
+
+	joined := &ResponseCache{encode: JSONEncoding{}}
+	require.NoError(t, joined.JoinBody(head, body))
+	assert.Equal(t, respCache.Status, joined.Status)
+	assert.Equal(t, respCache.Header, joined.Header)
+	assert.Equal(t, respCache.Data, joined.Data)
+}
+
+// reverseCompressor a fake content-coding which reverses the body
+type reverseCompressor struct{}
+
+func (reverseCompressor) ContentEncoding() string { return "reverse" }
+
+func (reverseCompressor) Compress(data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[len(data)-1-i] = b
+	}
+	return out, nil
+}
+
+func (r reverseCompressor) Decompress(data []byte) ([]byte, error) {
+	return r.Compress(data)
+}
+
+func TestCacheCompressors(t *testing.T) {
+	store := newStore(time.Second * 60)
+
+	r := gin.New()
+	r.GET("/cache/compress",
+		Cache(
+			WithCacheStore(store),
+			WithCompressors(GzipCompressor{}, BrotliCompressor{}),
+			WithHandle(func(c *gin.Context) {
+				c.String(http.StatusOK, "hello "+generateID())
+			}),
+		),
+	)
+
+	request := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/cache/compress", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// the miss is served as rendered
+	w1 := request("gzip")
+	assert.Empty(t, w1.Header().Get("Content-Encoding"))
+	body := w1.Body.String()
+
+	w2 := request("gzip, deflate")
+	assert.Equal(t, "gzip", w2.Header().Get("Content-Encoding"))
+	assert.Equal(t, []string{"Accept-Encoding"}, w2.Header().Values("Vary"))
+	data, err := GzipCompressor{}.Decompress(w2.Body.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, body, string(data))
+
+	w3 := request("gzip;q=0.5, br")
+	assert.Equal(t, "br", w3.Header().Get("Content-Encoding"))
+	data, err = BrotliCompressor{}.Decompress(w3.Body.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, body, string(data))
+
+	for _, accept := range []string{"", "identity", "zstd", "gzip;q=0"} {
+		w := request(accept)
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+		assert.Equal(t, body, w.Body.String())
+	}
+}
+
+func TestAcceptEncodingQ(t *testing.T) {
+	assert.Equal(t, 1.0, acceptEncodingQ("gzip", "gzip"))
+	assert.Equal(t, 1.0, acceptEncodingQ("deflate, GZIP", "gzip"))
+	assert.Equal(t, 0.5, acceptEncodingQ("br, gzip;q=0.5", "gzip"))
+	assert.Equal(t, 0.0, acceptEncodingQ("gzip;q=0, *", "gzip"))
+	assert.Equal(t, 0.3, acceptEncodingQ("br, *;q=0.3", "gzip"))
+	assert.True(t, acceptEncodingQ("br", "gzip") <= 0)
+	assert.True(t, acceptEncodingQ("", "gzip") <= 0)
+}
+
 func TestDiscard(_ *testing.T) {
 	l := NewDiscard()
 	l.Debugf("")
@@ -449,3 +1296,609 @@ func TestJSONGzipEncoding(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, want, got)
 }
+
+func TestCacheCompressorsHTTPOnly(t *testing.T) {
+	for _, compressor := range []Compressor{SnappyCompressor{}, reverseCompressor{}} {
+		assert.Panics(t, func() { WithCompressors(GzipCompressor{}, compressor) })
+	}
+	assert.NotPanics(t, func() { WithCompressors(GzipCompressor{}, BrotliCompressor{Level: 5}, ZstdCompressor{}) })
+}
+
+func TestCompressEncoding(t *testing.T) {
+	want := *benchmarkResponseCache(4 << 10)
+
+	compressors := []Compressor{nil, GzipCompressor{Level: 1}, ZstdCompressor{}, ZstdCompressor{Level: 19}, SnappyCompressor{}}
+	for i, compressor := range compressors {
+		encode := CompressEncoding{Encoding: BinaryEncoding{}, Compressor: compressor}
+
+		data, err := encode.Marshal(want)
+		require.NoError(t, err)
+		require.Equal(t, i > 0, len(data) < len(want.Data), "compressor %d", i)
+
+		// the compressor is detected by the header byte
+		got := ResponseCache{}
+		err = CompressEncoding{Encoding: BinaryEncoding{}}.Unmarshal(data, &got)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+
+	encode := CompressEncoding{Compressor: GzipCompressor{}, MinSize: 1 << 20}
+	data, err := encode.Marshal("foo")
+	require.NoError(t, err)
+	require.Equal(t, append([]byte{compressRaw}, `"foo"`...), data)
+	var got string
+	require.NoError(t, encode.Unmarshal(data, &got))
+	require.Equal(t, "foo", got)
+
+	require.Equal(t, ErrCompressFormat, encode.Unmarshal(nil, &got))
+	require.Equal(t, ErrCompressFormat, encode.Unmarshal([]byte{99}, &got))
+	require.Error(t, encode.Unmarshal([]byte{compressGzip, 1, 2}, &got))
+	_, err = CompressEncoding{Compressor: reverseCompressor{}}.Marshal("foo")
+	require.Error(t, err)
+}
+
+func TestEncryptEncoding(t *testing.T) {
+	want := *benchmarkResponseCache(1 << 10)
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 16)
+
+	keyring1, err := NewKeyring("k1", map[string][]byte{"k1": key1})
+	require.NoError(t, err)
+	keyring2, err := NewKeyring("k2", map[string][]byte{"k1": key1, "k2": key2})
+	require.NoError(t, err)
+	keyring3, err := NewKeyring("k2", map[string][]byte{"k2": key2})
+	require.NoError(t, err)
+
+	for _, inner := range []Encoding{nil, JSONGzipEncoding{}, CompressEncoding{Encoding: BinaryEncoding{}, Compressor: SnappyCompressor{}}} {
+		encode1 := EncryptEncoding{Encoding: inner, Keyring: keyring1}
+		encode2 := EncryptEncoding{Encoding: inner, Keyring: keyring2}
+		encode3 := EncryptEncoding{Encoding: inner, Keyring: keyring3}
+
+		data, err := encode1.Marshal(want)
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(data, want.Data[:32]))
+
+		got := ResponseCache{}
+		require.NoError(t, encode1.Unmarshal(data, &got))
+		require.Equal(t, want, got)
+
+		// rotated, the old key is still readable
+		got = ResponseCache{}
+		require.NoError(t, encode2.Unmarshal(data, &got))
+		require.Equal(t, want, got)
+
+		// the old key has been removed
+		err = encode3.Unmarshal(data, &got)
+		require.Equal(t, ErrDecrypt, err)
+		require.True(t, errors.Is(err, persist.ErrCacheMiss))
+
+		data, err = encode2.Marshal(want)
+		require.NoError(t, err)
+		got = ResponseCache{}
+		require.NoError(t, encode3.Unmarshal(data, &got))
+		require.Equal(t, want, got)
+
+		// tampered
+		data[len(data)-1] ^= 1
+		require.Equal(t, ErrDecrypt, encode3.Unmarshal(data, &got))
+		require.Equal(t, ErrDecrypt, encode3.Unmarshal(data[:5], &got))
+		require.Equal(t, ErrDecrypt, encode3.Unmarshal(nil, &got))
+	}
+
+	_, err = NewKeyring("k3", map[string][]byte{"k1": key1})
+	require.Error(t, err)
+	_, err = NewKeyring("k1", map[string][]byte{"k1": []byte("short")})
+	require.Error(t, err)
+
+	// no keyring, or a keyring not created by NewKeyring
+	for _, encode := range []EncryptEncoding{{}, {Keyring: &Keyring{}}} {
+		_, err = encode.Marshal(want)
+		require.Equal(t, ErrNoKeyring, err)
+		require.Equal(t, ErrNoKeyring, encode.Unmarshal([]byte{encryptVersion, 0}, &ResponseCache{}))
+		require.False(t, unknownKey(encode, []byte{encryptVersion, 0}))
+	}
+}
+
+func TestCacheEncryptKeyRollout(t *testing.T) {
+	store := newBinaryStore(time.Minute)
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 32)
+	oldKeyring, err := NewKeyring("k1", map[string][]byte{"k1": key1})
+	require.NoError(t, err)
+	newKeyring, err := NewKeyring("k2", map[string][]byte{"k1": key1, "k2": key2})
+	require.NoError(t, err)
+
+	var corrupted int32
+	newEngine := func(keyring *Keyring, body string) *gin.Engine {
+		r := gin.New()
+		r.GET("/rollout",
+			Cache(
+				WithCacheStore(store),
+				WithEncoding(EncryptEncoding{Keyring: keyring}),
+				WithOnCorrupt(func(c *gin.Context, key string, err error) {
+					atomic.AddInt32(&corrupted, 1)
+				}),
+				WithHandle(func(c *gin.Context) {
+					c.String(http.StatusOK, body)
+				}),
+			),
+		)
+		return r
+	}
+	upgraded := newEngine(newKeyring, "upgraded")
+	old := newEngine(oldKeyring, "old")
+
+	// the entry written by the upgraded instance is a plain miss for the old one, not corrupt
+	assert.Equal(t, "upgraded", performRequest("/rollout", upgraded).Body.String())
+	key, _ := GenerateCacheKeyByURI(&gin.Context{Request: httptest.NewRequest(http.MethodGet, "/rollout", nil)})
+	respCache := &ResponseCache{encode: EncryptEncoding{Keyring: oldKeyring}}
+	err = store.Get(key, respCache)
+	assert.True(t, errors.Is(err, ErrDecrypt))
+	assert.False(t, errors.Is(err, ErrCorrupt))
+
+	assert.Equal(t, "old", performRequest("/rollout", old).Body.String())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&corrupted))
+
+	// the data which fails to decrypt by a known key is still corrupt
+	payload, err := EncryptEncoding{Keyring: oldKeyring}.Marshal(&ResponseCache{Status: http.StatusOK})
+	require.NoError(t, err)
+	payload[len(payload)-1] ^= 1
+	err = respCache.UnmarshalBinary(marshalFrame(payload, ResponseCacheVersion))
+	assert.True(t, errors.Is(err, ErrDecrypt))
+	assert.True(t, errors.Is(err, ErrCorrupt))
+}
+
+func TestMsgPackEncoding(t *testing.T) {
+	want := ResponseCache{
+		Status:   200,
+		Header:   http.Header{"Content-Type": {"text/plain"}, "Link": {"a", "b"}},
+		Data:     []byte{1, 20, 3, 90},
+		Variants: map[string][]byte{"br": {4, 5}},
+		encode:   nil,
+	}
+
+	encode := MsgPackEncoding{}
+
+	data, err := encode.Marshal(want)
+	require.NoError(t, err)
+
+	got := ResponseCache{}
+	err = encode.Unmarshal(data, &got)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	// through ResponseCache itself, msgpack must not call MarshalBinary recursively
+	want.encode = encode
+	data, err = want.MarshalBinary()
+	require.NoError(t, err)
+	got = ResponseCache{encode: encode}
+	require.NoError(t, got.UnmarshalBinary(data))
+	require.Equal(t, want, got)
+}
+
+func TestBinaryEncoding(t *testing.T) {
+	want := ResponseCache{
+		Status:   200,
+		Header:   http.Header{"Content-Type": {"text/plain"}, "Link": {"a", "b"}, "Empty": {}},
+		Data:     []byte{1, 20, 3, 90},
+		Variants: map[string][]byte{"br": {4, 5}},
+		encode:   nil,
+	}
+
+	encode := BinaryEncoding{}
+
+	data, err := encode.Marshal(want)
+	require.NoError(t, err)
+
+	got := ResponseCache{}
+	err = encode.Unmarshal(data, &got)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	// unknown sections are skipped
+	got = ResponseCache{}
+	err = encode.Unmarshal(append(data, 99, 2, 1, 2), &got)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	// truncated data is rejected
+	for i := 1; i < len(data)-1; i++ {
+		got = ResponseCache{}
+		err = encode.Unmarshal(data[:i], &got)
+		if err == nil {
+			// a truncation at a section boundary is still a valid prefix
+			continue
+		}
+		require.Equal(t, ErrBinaryFormat, err)
+	}
+	require.Equal(t, ErrBinaryFormat, encode.Unmarshal([]byte{}, &got))
+	require.Equal(t, ErrBinaryFormat, encode.Unmarshal([]byte{binaryVersion, binaryTagData, 10, 1}, &got))
+
+	_, err = encode.Marshal("foo")
+	require.Error(t, err)
+	require.Error(t, encode.Unmarshal(data, new(string)))
+}
+
+func TestCacheRefreshAhead(t *testing.T) {
+	store := memory.NewShardedStore(time.Minute, 0)
+	defer store.Close()
+	var calls int32
+	r := gin.New()
+	r.GET("/refresh/:id",
+		Cache(
+			WithCacheStore(store),
+			WithExpire(300*time.Millisecond),
+			WithRefreshAhead(RefreshAhead{Fraction: 0.5, MinHits: 2}),
+			WithHandle(func(c *gin.Context) {
+				n := atomic.AddInt32(&calls, 1)
+				// the refresh must not run with the context of the finished request
+				if err := c.Request.Context().Err(); err != nil {
+					c.String(http.StatusInternalServerError, err.Error())
+					return
+				}
+				c.String(http.StatusOK, fmt.Sprintf("%s-%d", c.Param("id"), n))
+			}),
+		),
+	)
+
+	assert.Equal(t, "hot-1", performRequest("/refresh/hot", r).Body.String())
+	assert.Equal(t, "cold-2", performRequest("/refresh/cold", r).Body.String())
+	// the hits early in the ttl do not refresh
+	assert.Equal(t, "hot-1", performRequest("/refresh/hot", r).Body.String())
+	assert.Equal(t, "hot-1", performRequest("/refresh/hot", r).Body.String())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	time.Sleep(200 * time.Millisecond)
+	// a popular key in the last half of its ttl is refreshed in background, a cold one is not
+	assert.Equal(t, "hot-1", performRequest("/refresh/hot", r).Body.String())
+	assert.Equal(t, "cold-2", performRequest("/refresh/cold", r).Body.String())
+	require.Eventually(t, func() bool {
+		return performRequest("/refresh/hot", r).Body.String() == "hot-3"
+	}, time.Second, 10*time.Millisecond)
+
+	// the refreshed entry outlives the original ttl, the cold one expires
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, "hot-3", performRequest("/refresh/hot", r).Body.String())
+	assert.Equal(t, "cold-4", performRequest("/refresh/cold", r).Body.String())
+}
+
+func TestCacheRefreshAheadAborted(t *testing.T) {
+	store := memory.NewShardedStore(time.Minute, 0)
+	defer store.Close()
+	var calls int32
+	r := gin.New()
+	r.GET("/refresh",
+		Cache(
+			WithCacheStore(store),
+			WithExpire(300*time.Millisecond),
+			WithRefreshAhead(RefreshAhead{Fraction: 0.5, MinHits: 1}),
+			WithHandle(func(c *gin.Context) {
+				n := atomic.AddInt32(&calls, 1)
+				c.String(http.StatusOK, fmt.Sprintf("v%d", n))
+				if n > 1 {
+					// the re-render is aborted after writing 200, it must not replace the entry
+					c.Abort()
+				}
+			}),
+		),
+	)
+
+	assert.Equal(t, "v1", performRequest("/refresh", r).Body.String())
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, "v1", performRequest("/refresh", r).Body.String())
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 2 }, time.Second, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, "v1", performRequest("/refresh", r).Body.String())
+}
+
+func TestRefresherFromTTL(t *testing.T) {
+	store := memory.NewShardedStore(time.Minute, 0)
+	defer store.Close()
+	options := newOptions(WithCacheStore(store), WithExpire(time.Minute), WithRefreshAhead(RefreshAhead{MinHits: 1, MaxConcurrent: 1}))
+
+	// the entries set by another process are asked for the ttl
+	require.NoError(t, store.Set("near", "near", 5*time.Second))
+	require.NoError(t, store.Set("far", "far", time.Minute))
+	require.NoError(t, store.Set("other", "other", time.Second))
+	assert.False(t, options.refresher.hit(options, "far"))
+	assert.False(t, options.refresher.hit(options, "missing"))
+	assert.True(t, options.refresher.hit(options, "near"))
+	// one refresh of a key at a time, and no more than MaxConcurrent
+	assert.False(t, options.refresher.hit(options, "near"))
+	assert.False(t, options.refresher.hit(options, "other"))
+	options.refresher.done("near")
+	assert.True(t, options.refresher.hit(options, "other"))
+}
+
+// fakeLocker an in-process stand-in of a distributed locker
+type fakeLocker struct {
+	mu    sync.Mutex
+	held  map[string]int64
+	fence int64
+}
+
+type fakeLease struct {
+	locker *fakeLocker
+	key    string
+	fence  int64
+}
+
+func (l *fakeLocker) TryLock(key string, _ time.Duration) (persist.Lease, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.held[key]; ok {
+		return nil, persist.ErrLocked
+	}
+	l.fence++
+	l.held[key] = l.fence
+	return &fakeLease{locker: l, key: key, fence: l.fence}, nil
+}
+
+func (l *fakeLease) Fence() int64 { return l.fence }
+
+func (l *fakeLease) Release() error {
+	l.locker.mu.Lock()
+	defer l.locker.mu.Unlock()
+	if l.locker.held[l.key] == l.fence {
+		delete(l.locker.held, l.key)
+	}
+	return nil
+}
+
+func TestCacheDistributedLock(t *testing.T) {
+	store := memory.NewShardedStore(time.Minute, 0)
+	defer store.Close()
+	locker := &fakeLocker{held: make(map[string]int64)}
+	var calls int32
+	r := gin.New()
+	r.GET("/lock/:id",
+		Cache(
+			WithCacheStore(store),
+			WithDistributedLock(locker, DistributedLock{Wait: 200 * time.Millisecond, PollInterval: 10 * time.Millisecond}),
+			WithHandle(func(c *gin.Context) {
+				atomic.AddInt32(&calls, 1)
+				// the fencing token is absent when rendered without the lock
+				fence, _ := c.Get(LockFenceKey)
+				c.String(http.StatusOK, fmt.Sprintf("%s-%v", c.Param("id"), fence))
+			}),
+		),
+	)
+
+	// the lock is acquired and released while rendering
+	assert.Equal(t, "free-1", performRequest("/lock/free", r).Body.String())
+	assert.Empty(t, locker.held)
+
+	// another instance holds the lock and renders the entry meanwhile
+	lease, err := locker.TryLock(CacheKeyWithPrefix(PageCachePrefix, url.QueryEscape("/lock/held")), time.Second)
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		other := &ResponseCache{Status: http.StatusOK, Header: make(http.Header), Data: []byte("other"), encode: JSONEncoding{}}
+		_ = store.Set(CacheKeyWithPrefix(PageCachePrefix, url.QueryEscape("/lock/held")), other, time.Minute)
+	}()
+	w := performRequest("/lock/held", r)
+	assert.Equal(t, "other", w.Body.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	require.NoError(t, lease.Release())
+
+	// the holder fails to render, it is rendered anyway after waiting
+	_, err = locker.TryLock(CacheKeyWithPrefix(PageCachePrefix, url.QueryEscape("/lock/lost")), time.Second)
+	require.NoError(t, err)
+	start := time.Now()
+	w = performRequest("/lock/lost", r)
+	assert.Equal(t, "lost-<nil>", w.Body.String())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(200*time.Millisecond))
+}
+
+func TestCacheDistributedLockFenced(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store := redisStore.NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	cacheKey := CacheKeyWithPrefix(PageCachePrefix, url.QueryEscape("/fenced"))
+	r := gin.New()
+	r.GET("/fenced",
+		Cache(
+			WithCacheStore(store),
+			WithDistributedLock(store, DistributedLock{TTL: time.Second}),
+			WithHandle(func(c *gin.Context) {
+				// the lease expires during the render, the next holder writes a newer entry
+				mr.FastForward(2 * time.Second)
+				lease, err := store.TryLock(cacheKey, time.Second)
+				require.NoError(t, err)
+				next := &ResponseCache{Status: http.StatusOK, Header: make(http.Header), Data: []byte("next"), encode: JSONEncoding{}}
+				require.NoError(t, store.SetFenced(cacheKey, next, time.Minute, lease.Fence()))
+				c.String(http.StatusOK, "stale")
+			}),
+		),
+	)
+
+	assert.Equal(t, "stale", performRequest("/fenced", r).Body.String())
+	// the stale holder does not overwrite the entry of the next one
+	assert.Equal(t, "next", performRequest("/fenced", r).Body.String())
+}
+
+func TestWarmer(t *testing.T) {
+	store := newStore(time.Minute)
+	var calls int32
+	r := gin.New()
+	r.GET("/page/:id",
+		Cache(
+			WithCacheStore(store),
+			WithExpire(time.Minute),
+			WithHandle(func(c *gin.Context) {
+				atomic.AddInt32(&calls, 1)
+				if c.Param("id") == "missing" {
+					c.String(http.StatusNotFound, "not found")
+					return
+				}
+				if c.Param("id") == "panic" {
+					panic("boom")
+				}
+				c.String(http.StatusOK, c.Request.Host+c.Request.RequestURI)
+			}),
+		),
+	)
+
+	warmer := NewWarmer(r, WithWarmConcurrency(2), WithWarmHost("example.com"))
+	report := warmer.Warm(context.Background(), []string{
+		"/page/1", "/page/2?q=1", "http://example.org/page/3", "/page/missing", "/page/panic", "%zz",
+	})
+	require.Equal(t, 6, report.Total)
+	require.Equal(t, 3, report.Succeeded)
+	require.Len(t, report.Failures, 3)
+	failures := make(map[string]WarmFailure)
+	for _, f := range report.Failures {
+		failures[f.URI] = f
+	}
+	assert.Equal(t, http.StatusNotFound, failures["/page/missing"].Status)
+	assert.Error(t, failures["/page/panic"].Err)
+	assert.Error(t, failures["%zz"].Err)
+
+	// the warmed pages are served from the cache
+	atomic.StoreInt32(&calls, 0)
+	w := performRequest("/page/2?q=1", r)
+	assert.Equal(t, "example.com/page/2?q=1", w.Body.String())
+	w = performRequest("/page/3", r)
+	assert.Equal(t, "example.org/page/3", w.Body.String())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+}
+
+func TestWarmerRateAndCancel(t *testing.T) {
+	var calls int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	})
+	uris := []string{"/1", "/2", "/3", "/4", "/5"}
+
+	start := time.Now()
+	report := NewWarmer(handler, WithWarmRate(100)).Warm(context.Background(), uris)
+	assert.Equal(t, 5, report.Succeeded)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(40*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report = NewWarmer(handler).Warm(ctx, uris)
+	assert.Equal(t, 0, report.Succeeded)
+	require.Len(t, report.Failures, 5)
+	assert.Equal(t, context.Canceled, report.Failures[0].Err)
+}
+
+func TestWarmSitemap(t *testing.T) {
+	sitemap := `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url><loc>https://example.com/</loc><lastmod>2021-01-01</lastmod></url>
+	<url><loc>https://example.com/about?lang=en</loc></url>
+</urlset>`
+	var got []string
+	var mu sync.Mutex
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.Host+r.RequestURI)
+		mu.Unlock()
+	})
+
+	report, err := NewWarmer(handler, WithWarmConcurrency(1)).WarmSitemap(context.Background(), strings.NewReader(sitemap))
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Succeeded)
+	assert.Equal(t, []string{"example.com/", "example.com/about?lang=en"}, got)
+
+	_, err = ParseSitemap(strings.NewReader("<sitemapindex></sitemapindex>"))
+	assert.Error(t, err)
+}
+
+func benchmarkResponseCache(size int) *ResponseCache {
+	return &ResponseCache{
+		Status: http.StatusOK,
+		Header: http.Header{
+			"Content-Type":  {"text/html; charset=utf-8"},
+			"Cache-Control": {"public, max-age=60"},
+			"Link":          {"</a.css>; rel=preload", "</b.js>; rel=preload"},
+		},
+		Data: bytes.Repeat([]byte("<p>hello world</p>"), size/18+1)[:size],
+	}
+}
+
+func BenchmarkEncoding(b *testing.B) {
+	encodings := []struct {
+		name   string
+		encode Encoding
+	}{
+		{"json", JSONEncoding{}},
+		{"msgpack", MsgPackEncoding{}},
+		{"binary", BinaryEncoding{}},
+		{"binary+gzip", CompressEncoding{Encoding: BinaryEncoding{}, Compressor: GzipCompressor{}}},
+		{"binary+zstd", CompressEncoding{Encoding: BinaryEncoding{}, Compressor: ZstdCompressor{}}},
+		{"binary+snappy", CompressEncoding{Encoding: BinaryEncoding{}, Compressor: SnappyCompressor{}}},
+	}
+
+	for _, size := range []int{1 << 10, 64 << 10, 1 << 20} {
+		for _, e := range encodings {
+			want := benchmarkResponseCache(size)
+			b.Run(fmt.Sprintf("%s/%dKB", e.name, size>>10), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					data, err := e.encode.Marshal(want)
+					if err != nil {
+						b.Fatal(err)
+					}
+					var got ResponseCache
+					if err := e.encode.Unmarshal(data, &got); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// discardResponseWriter a http.ResponseWriter which reuses its header and discards the body
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponseWriter) Header() http.Header { return w.header }
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+func (w *discardResponseWriter) WriteHeader(status int) { w.status = status }
+
+func BenchmarkCacheHit(b *testing.B) {
+	stores := []struct {
+		name  string
+		store persist.CacheStore
+	}{
+		{"memory", memory.NewMemoryStore(time.Hour)},
+		{"sharded", memory.NewShardedStore(time.Hour, 0)},
+		// hide the Loader to compare with copying and decoding on every hit
+		{"memory-copy", struct{ persist.CacheStore }{memory.NewMemoryStore(time.Hour)}},
+		{"memory-decode", struct{ persist.CacheStore }{newBinaryStore(time.Hour)}},
+	}
+	for _, s := range stores {
+		b.Run(s.name, func(b *testing.B) {
+			r := gin.New()
+			r.GET("/cache/hit",
+				Cache(
+					WithCacheStore(s.store),
+					WithHandle(func(c *gin.Context) {
+						c.Header("X-Id", generateID())
+						c.Data(http.StatusOK, "text/plain", bytes.Repeat([]byte("x"), 4<<10))
+					}),
+				),
+			)
+			req := httptest.NewRequest(http.MethodGet, "/cache/hit", nil)
+			w := &discardResponseWriter{header: make(http.Header)}
+			r.ServeHTTP(w, req)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for k := range w.header {
+					delete(w.header, k)
+				}
+				r.ServeHTTP(w, req)
+			}
+		})
+	}
+}
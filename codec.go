@@ -3,7 +3,13 @@ package wcache
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 // Encoding interface
@@ -49,3 +55,296 @@ func (JSONGzipEncoding) Unmarshal(data []byte, v interface{}) error {
 	}()
 	return json.NewDecoder(reader).Decode(v)
 }
+
+// the header bytes of CompressEncoding, telling how the rest of the data is compressed
+const (
+	compressRaw byte = iota
+	compressGzip
+	compressZstd
+	compressSnappy
+)
+
+// ErrCompressFormat the data is not a valid CompressEncoding format
+var ErrCompressFormat = errors.New("wcache: invalid compress encoding format")
+
+// CompressEncoding wrap an Encoding and compress its output. the data is prefixed by a
+// header byte telling the compressor used, so Unmarshal detects it automatically and the
+// compressor can be changed without flushing the cache. data smaller than MinSize, or not
+// getting smaller after compression, is stored raw.
+type CompressEncoding struct {
+	// Encoding the wrapped encoding, nil means JSONEncoding
+	Encoding Encoding
+	// Compressor one of GzipCompressor, ZstdCompressor and SnappyCompressor, nil means raw
+	Compressor Compressor
+	// MinSize the data smaller than it is stored raw
+	MinSize int
+}
+
+func (e CompressEncoding) Marshal(v interface{}) ([]byte, error) {
+	data, err := e.encoding().Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Compressor != nil && len(data) >= e.MinSize {
+		id, ok := compressorIDs[e.Compressor.ContentEncoding()]
+		if !ok {
+			return nil, fmt.Errorf("wcache: compress encoding does not support %s", e.Compressor.ContentEncoding())
+		}
+		compressed, err := e.Compressor.Compress(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(data) {
+			return append([]byte{id}, compressed...), nil
+		}
+	}
+	return append([]byte{compressRaw}, data...), nil
+}
+
+func (e CompressEncoding) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return ErrCompressFormat
+	}
+
+	payload := data[1:]
+	switch data[0] {
+	case compressRaw:
+	case compressGzip, compressZstd, compressSnappy:
+		var err error
+		if payload, err = compressorsByID[data[0]].Decompress(payload); err != nil {
+			return err
+		}
+	default:
+		return ErrCompressFormat
+	}
+	return e.encoding().Unmarshal(payload, v)
+}
+
+func (e CompressEncoding) encoding() Encoding {
+	if e.Encoding == nil {
+		return JSONEncoding{}
+	}
+	return e.Encoding
+}
+
+var compressorIDs = map[string]byte{
+	"gzip":   compressGzip,
+	"zstd":   compressZstd,
+	"snappy": compressSnappy,
+}
+
+var compressorsByID = map[byte]Compressor{
+	compressGzip:   GzipCompressor{},
+	compressZstd:   ZstdCompressor{},
+	compressSnappy: SnappyCompressor{},
+}
+
+// MsgPackEncoding encode with MessagePack, it keeps ResponseCache.Data as raw bytes
+type MsgPackEncoding struct{}
+
+// msgPackResponseCache has the fields of ResponseCache without its methods,
+// so that msgpack will not call back into ResponseCache.MarshalBinary
+type msgPackResponseCache ResponseCache
+
+func (MsgPackEncoding) Marshal(v interface{}) ([]byte, error) {
+	switch c := v.(type) {
+	case *ResponseCache:
+		return msgpack.Marshal((*msgPackResponseCache)(c))
+	case ResponseCache:
+		return msgpack.Marshal(msgPackResponseCache(c))
+	}
+	return msgpack.Marshal(v)
+}
+
+func (MsgPackEncoding) Unmarshal(data []byte, v interface{}) error {
+	if c, ok := v.(*ResponseCache); ok {
+		return msgpack.Unmarshal(data, (*msgPackResponseCache)(c))
+	}
+	return msgpack.Unmarshal(data, v)
+}
+
+// binaryVersion the version of the BinaryEncoding format
+const binaryVersion byte = 1
+
+// the section tags of the BinaryEncoding format, unknown sections are skipped when decoding
+const (
+	binaryTagStatus byte = iota + 1
+	binaryTagHeader
+	binaryTagData
+	binaryTagVariants
+)
+
+// ErrBinaryFormat the data is not a valid BinaryEncoding format
+var ErrBinaryFormat = errors.New("wcache: invalid binary encoding format")
+
+// BinaryEncoding a compact length-prefixed binary encoding for ResponseCache only.
+// the format is a version byte followed by the sections of status, header, data and
+// variants, each section is a tag byte, a uvarint length and the content.
+type BinaryEncoding struct{}
+
+func (BinaryEncoding) Marshal(v interface{}) ([]byte, error) {
+	var c *ResponseCache
+	switch rc := v.(type) {
+	case *ResponseCache:
+		c = rc
+	case ResponseCache:
+		c = &rc
+	default:
+		return nil, fmt.Errorf("wcache: binary encoding does not support %T", v)
+	}
+
+	var section []byte
+	buf := make([]byte, 0, len(c.Data)+256)
+	buf = append(buf, binaryVersion)
+
+	section = appendUvarint(section[:0], uint64(c.Status))
+	buf = appendSection(buf, binaryTagStatus, section)
+
+	section = appendUvarint(section[:0], uint64(len(c.Header)))
+	for key, values := range c.Header {
+		section = appendBytes(section, []byte(key))
+		section = appendUvarint(section, uint64(len(values)))
+		for _, value := range values {
+			section = appendBytes(section, []byte(value))
+		}
+	}
+	buf = appendSection(buf, binaryTagHeader, section)
+
+	buf = appendSection(buf, binaryTagData, c.Data)
+
+	if len(c.Variants) > 0 {
+		section = appendUvarint(section[:0], uint64(len(c.Variants)))
+		for coding, data := range c.Variants {
+			section = appendBytes(section, []byte(coding))
+			section = appendBytes(section, data)
+		}
+		buf = appendSection(buf, binaryTagVariants, section)
+	}
+	return buf, nil
+}
+
+func (BinaryEncoding) Unmarshal(data []byte, v interface{}) error {
+	c, ok := v.(*ResponseCache)
+	if !ok {
+		return fmt.Errorf("wcache: binary encoding does not support %T", v)
+	}
+	if len(data) == 0 || data[0] != binaryVersion {
+		return ErrBinaryFormat
+	}
+
+	r := binaryReader{data: data[1:]}
+	var out ResponseCache
+	for !r.eof() {
+		tag := r.byte()
+		section := binaryReader{data: r.bytes()}
+		switch tag {
+		case binaryTagStatus:
+			out.Status = int(section.uvarint())
+		case binaryTagHeader:
+			n := section.count()
+			out.Header = make(http.Header, n)
+			for i := 0; i < n && section.err == nil; i++ {
+				key := string(section.bytes())
+				values := make([]string, 0, section.count())
+				for j := cap(values); j > 0 && section.err == nil; j-- {
+					values = append(values, string(section.bytes()))
+				}
+				out.Header[key] = values
+			}
+		case binaryTagData:
+			// copy the data, the input may be reused or backed by an immutable string
+			out.Data = append([]byte(nil), section.data...)
+		case binaryTagVariants:
+			n := section.count()
+			out.Variants = make(map[string][]byte, n)
+			for i := 0; i < n && section.err == nil; i++ {
+				coding := string(section.bytes())
+				out.Variants[coding] = append([]byte(nil), section.bytes()...)
+			}
+		}
+		if section.err != nil {
+			return section.err
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	out.encode = c.encode
+	*c = out
+	return nil
+}
+
+func appendSection(buf []byte, tag byte, section []byte) []byte {
+	buf = append(buf, tag)
+	return appendBytes(buf, section)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(buf, b[:n]...)
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// binaryReader read the BinaryEncoding format, the first error is kept in err
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) eof() bool {
+	return r.err != nil || len(r.data) == 0
+}
+
+func (r *binaryReader) byte() byte {
+	if r.eof() {
+		r.err = ErrBinaryFormat
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = ErrBinaryFormat
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// count read the number of the following elements, each of them takes one byte at least
+func (r *binaryReader) count() int {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		r.err = ErrBinaryFormat
+		return 0
+	}
+	return int(n)
+}
+
+func (r *binaryReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)) {
+		r.err = ErrBinaryFormat
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
@@ -0,0 +1,301 @@
+package wcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor compress the cached body for a content-coding, such as gzip or br,
+// so that hits can be served pre-compressed without spending CPU.
+type Compressor interface {
+	// ContentEncoding the content-coding token used by Accept-Encoding and Content-Encoding
+	ContentEncoding() string
+	// Compress compress the body
+	Compress(data []byte) ([]byte, error)
+	// Decompress decompress the body for the clients which do not accept the coding
+	Decompress(data []byte) ([]byte, error)
+}
+
+// GzipCompressor compress the body with gzip
+type GzipCompressor struct {
+	// Level the gzip compression level, 0 means gzip.DefaultCompression
+	Level int
+}
+
+var _ Compressor = GzipCompressor{}
+
+// ContentEncoding implement Compressor interface
+func (GzipCompressor) ContentEncoding() string {
+	return "gzip"
+}
+
+// Compress implement Compressor interface
+func (g GzipCompressor) Compress(data []byte) ([]byte, error) {
+	level := g.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	buf := &bytes.Buffer{}
+	writer, err := gzip.NewWriterLevel(buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = writer.Write(data); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress implement Compressor interface
+func (GzipCompressor) Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// BrotliCompressor compress the body with brotli, the br content-coding
+type BrotliCompressor struct {
+	// Level the brotli compression level from 0 to 11, 0 means brotli.DefaultCompression
+	Level int
+}
+
+var _ Compressor = BrotliCompressor{}
+
+// ContentEncoding implement Compressor interface
+func (BrotliCompressor) ContentEncoding() string {
+	return "br"
+}
+
+// Compress implement Compressor interface
+func (b BrotliCompressor) Compress(data []byte) ([]byte, error) {
+	level := b.Level
+	if level == 0 {
+		level = brotli.DefaultCompression
+	}
+
+	buf := &bytes.Buffer{}
+	writer := brotli.NewWriterLevel(buf, level)
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress implement Compressor interface
+func (BrotliCompressor) Decompress(data []byte) ([]byte, error) {
+	return ioutil.ReadAll(brotli.NewReader(bytes.NewReader(data)))
+}
+
+// ZstdCompressor compress the body with zstd
+type ZstdCompressor struct {
+	// Level the zstd compression level from 1 to 22, 0 means zstd.SpeedDefault
+	Level int
+}
+
+var _ Compressor = ZstdCompressor{}
+
+var (
+	// zstdEncoders the shared encoders keyed by level, EncodeAll is safe for concurrent use
+	zstdEncoders sync.Map
+	zstdDecoder  *zstd.Decoder
+	zstdErr      error
+	zstdOnce     sync.Once
+)
+
+// ContentEncoding implement Compressor interface
+func (ZstdCompressor) ContentEncoding() string {
+	return "zstd"
+}
+
+// Compress implement Compressor interface
+func (z ZstdCompressor) Compress(data []byte) ([]byte, error) {
+	level := zstd.SpeedDefault
+	if z.Level > 0 {
+		level = zstd.EncoderLevelFromZstd(z.Level)
+	}
+
+	encoder, ok := zstdEncoders.Load(level)
+	if !ok {
+		e, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+		if err != nil {
+			return nil, err
+		}
+		encoder, _ = zstdEncoders.LoadOrStore(level, e)
+	}
+	return encoder.(*zstd.Encoder).EncodeAll(data, nil), nil
+}
+
+// Decompress implement Compressor interface
+func (ZstdCompressor) Decompress(data []byte) ([]byte, error) {
+	zstdOnce.Do(func() {
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	if zstdErr != nil {
+		return nil, zstdErr
+	}
+	return zstdDecoder.DecodeAll(data, nil)
+}
+
+// SnappyCompressor compress the body with snappy block format, it is fast but not a
+// standard http content-coding, so it is meant for CompressEncoding only, and rejected by WithCompressors
+type SnappyCompressor struct{}
+
+var _ Compressor = SnappyCompressor{}
+
+// ContentEncoding implement Compressor interface
+func (SnappyCompressor) ContentEncoding() string {
+	return "snappy"
+}
+
+// Compress implement Compressor interface
+func (SnappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+// Decompress implement Compressor interface
+func (SnappyCompressor) Decompress(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+// httpContentCodings the registered http content-codings the Compressors of WithCompressors may use
+var httpContentCodings = map[string]bool{"gzip": true, "deflate": true, "br": true, "zstd": true}
+
+// compressResponse compress the body by the first compressor, and store the variants of the
+// other compressors. responses already encoded by the handler are left as they are.
+func compressResponse(options *Options, respCache *ResponseCache) {
+	if len(options.compressors) == 0 || len(respCache.Data) == 0 ||
+		respCache.Header.Get("Content-Encoding") != "" {
+		return
+	}
+
+	primary, err := options.compressors[0].Compress(respCache.Data)
+	if err != nil {
+		options.logger.Errorf("compress response error: %s", err)
+		return
+	}
+
+	for _, compressor := range options.compressors[1:] {
+		data, err := compressor.Compress(respCache.Data)
+		if err != nil {
+			options.logger.Errorf("compress response error: %s", err)
+			continue
+		}
+		if respCache.Variants == nil {
+			respCache.Variants = make(map[string][]byte, len(options.compressors)-1)
+		}
+		respCache.Variants[compressor.ContentEncoding()] = data
+	}
+
+	respCache.Data = primary
+	respCache.Header.Set("Content-Encoding", options.compressors[0].ContentEncoding())
+	respCache.Header.Del("Content-Length")
+	if !containsString(respCache.Header.Values("Vary"), "Accept-Encoding") {
+		respCache.Header.Add("Vary", "Accept-Encoding")
+	}
+}
+
+// negotiateBody choose the body variant accepted by the client, and fix the Content-Encoding
+// header of the response. the body is decompressed on the fly if no variant is accepted.
+func negotiateBody(c *gin.Context, options *Options, respCache *ResponseCache) []byte {
+	contentEncoding := respCache.Header.Get("Content-Encoding")
+	if contentEncoding == "" || len(options.compressors) == 0 {
+		return respCache.Data
+	}
+	var primary Compressor
+	for _, compressor := range options.compressors {
+		if compressor.ContentEncoding() == contentEncoding {
+			primary = compressor
+			break
+		}
+	}
+	// encoded by the handler, serve as it is
+	if primary == nil {
+		return respCache.Data
+	}
+
+	accept := c.GetHeader("Accept-Encoding")
+	chosen, chosenQ := contentEncoding, acceptEncodingQ(accept, contentEncoding)
+	for _, compressor := range options.compressors {
+		coding := compressor.ContentEncoding()
+		if _, ok := respCache.Variants[coding]; ok {
+			if q := acceptEncodingQ(accept, coding); q > chosenQ {
+				chosen, chosenQ = coding, q
+			}
+		}
+	}
+
+	switch {
+	case chosenQ > 0 && chosen == contentEncoding:
+		return respCache.Data
+	case chosenQ > 0:
+		c.Writer.Header().Set("Content-Encoding", chosen)
+		return respCache.Variants[chosen]
+	}
+
+	c.Writer.Header().Del("Content-Encoding")
+	if c.Request.Method == http.MethodHead {
+		return nil
+	}
+	data, err := primary.Decompress(respCache.Data)
+	if err != nil {
+		options.logger.Errorf("decompress response error: %s", err)
+		c.Writer.Header().Set("Content-Encoding", contentEncoding)
+		return respCache.Data
+	}
+	return data
+}
+
+// acceptEncodingQ return the quality value of the coding in the Accept-Encoding header,
+// a value not greater than 0 means not acceptable
+func acceptEncodingQ(accept, coding string) float64 {
+	q, wildcard := -1.0, -1.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params := part, ""
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			name, params = part[:i], part[i+1:]
+		}
+		name = strings.TrimSpace(name)
+
+		value := 1.0
+		params = strings.TrimSpace(params)
+		if strings.HasPrefix(params, "q=") {
+			if v, err := strconv.ParseFloat(params[2:], 64); err == nil {
+				value = v
+			}
+		}
+
+		switch {
+		case strings.EqualFold(name, coding):
+			q = value
+		case name == "*":
+			wildcard = value
+		}
+	}
+
+	if q >= 0 {
+		return q
+	}
+	return wildcard
+}
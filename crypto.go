@@ -0,0 +1,142 @@
+package wcache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/wyy-go/wcache/persist"
+)
+
+// encryptVersion the version of the EncryptEncoding format
+const encryptVersion byte = 1
+
+// ErrDecrypt the cached data can not be decrypted, because it is corrupted, or encrypted by
+// a key not in the keyring. it is a persist.ErrCacheMiss, so the entry is re-rendered. the data of
+// an unknown key is not an ErrCorrupt, so that it is not deleted while the keyring rolls out.
+var ErrDecrypt = fmt.Errorf("wcache: decrypt cache error: %w", persist.ErrCacheMiss)
+
+// ErrNoKeyring the EncryptEncoding has no keyring, or the keyring is not created by NewKeyring
+var ErrNoKeyring = errors.New("wcache: encrypt encoding has no keyring")
+
+// Keyring hold the AES keys of EncryptEncoding by id. new data is encrypted by the primary key,
+// and data encrypted by the other keys is still readable, so keys can rotate without flushing
+// the cache: add the new key as primary, and remove the old one after the cache expires.
+type Keyring struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewKeyring create a keyring, the keys must be 16, 24 or 32 bytes to select AES-128, AES-192
+// or AES-256, and the id of each key must not be longer than 255 bytes.
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, errors.New("wcache: primary key is not in the keyring")
+	}
+
+	aeads := make(map[string]cipher.AEAD, len(keys))
+	for id, key := range keys {
+		if len(id) > 255 {
+			return nil, fmt.Errorf("wcache: key id is too long: %s", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("wcache: invalid key %s: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		aeads[id] = aead
+	}
+	return &Keyring{primary: primary, aeads: aeads}, nil
+}
+
+// EncryptEncoding wrap an Encoding and encrypt its output with AES-GCM, it is meant for
+// the stores shared with others. the data carries the id of the key, see Keyring.
+// to compress the data, wrap the CompressEncoding, not the other way around.
+type EncryptEncoding struct {
+	// Encoding the wrapped encoding, nil means JSONEncoding
+	Encoding Encoding
+	// Keyring the keys to encrypt and decrypt
+	Keyring *Keyring
+}
+
+func (e EncryptEncoding) Marshal(v interface{}) ([]byte, error) {
+	data, err := e.encoding().Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Keyring == nil {
+		return nil, ErrNoKeyring
+	}
+	aead, ok := e.Keyring.aeads[e.Keyring.primary]
+	if !ok {
+		return nil, ErrNoKeyring
+	}
+	header := make([]byte, 0, 2+len(e.Keyring.primary)+aead.NonceSize())
+	header = append(header, encryptVersion, byte(len(e.Keyring.primary)))
+	header = append(header, e.Keyring.primary...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(header)+len(nonce)+len(data)+aead.Overhead())
+	out = append(out, header...)
+	out = append(out, nonce...)
+	// the header is authenticated too, so the key id can not be swapped
+	return aead.Seal(out, nonce, data, header), nil
+}
+
+func (e EncryptEncoding) Unmarshal(data []byte, v interface{}) error {
+	if e.Keyring == nil || len(e.Keyring.aeads) == 0 {
+		return ErrNoKeyring
+	}
+	if len(data) < 2 || data[0] != encryptVersion || len(data) < 2+int(data[1]) {
+		return ErrDecrypt
+	}
+	headerSize := 2 + int(data[1])
+	aead, ok := e.Keyring.aeads[string(data[2:headerSize])]
+	if !ok || len(data) < headerSize+aead.NonceSize() {
+		return ErrDecrypt
+	}
+
+	header, rest := data[:headerSize], data[headerSize:]
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return ErrDecrypt
+	}
+	return e.encoding().Unmarshal(plain, v)
+}
+
+// unknownKey report whether the data is encrypted by encode, which is an EncryptEncoding,
+// with a key whose id is not in the keyring
+func unknownKey(encode Encoding, data []byte) bool {
+	var e EncryptEncoding
+	switch v := encode.(type) {
+	case EncryptEncoding:
+		e = v
+	case *EncryptEncoding:
+		e = *v
+	default:
+		return false
+	}
+	if e.Keyring == nil || len(e.Keyring.aeads) == 0 || len(data) < 2 || data[0] != encryptVersion || len(data) < 2+int(data[1]) {
+		return false
+	}
+	_, ok := e.Keyring.aeads[string(data[2:2+int(data[1])])]
+	return !ok
+}
+
+func (e EncryptEncoding) encoding() Encoding {
+	if e.Encoding == nil {
+		return JSONEncoding{}
+	}
+	return e.Encoding
+}
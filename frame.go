@@ -0,0 +1,96 @@
+package wcache
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+
+	"github.com/wyy-go/wcache/persist"
+)
+
+// frameMagic the leading bytes of an encoded ResponseCache, the data without it is
+// from the versions before the frame was introduced
+var frameMagic = [2]byte{'w', 'c'}
+
+const (
+	// frameVersion the version of the frame format, version 1 has no schema version
+	frameVersion byte = 2
+	// frameV1HeaderSize magic, version and the crc32 checksum of the payload
+	frameV1HeaderSize = len(frameMagic) + 1 + 4
+	// frameHeaderSize magic, version, schema version and the crc32 checksum of the schema version and the payload
+	frameHeaderSize = len(frameMagic) + 1 + 1 + 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorrupt the cached data is truncated, fails the checksum or can not be decoded.
+// it is a persist.ErrCacheMiss, and Cache deletes the corrupt key, see WithOnCorrupt.
+var ErrCorrupt = errors.New("wcache: corrupt cache")
+
+// corruptError wrap the error of decoding as ErrCorrupt
+type corruptError struct {
+	err error
+}
+
+func (e *corruptError) Error() string {
+	return ErrCorrupt.Error() + ": " + e.err.Error()
+}
+
+func (e *corruptError) Unwrap() error {
+	return e.err
+}
+
+func (e *corruptError) Is(target error) bool {
+	return target == ErrCorrupt || target == persist.ErrCacheMiss
+}
+
+// marshalFrame prefix the payload with the frame header
+func marshalFrame(payload []byte, schema uint8) []byte {
+	data := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	copy(data, frameMagic[:])
+	data[len(frameMagic)] = frameVersion
+	data[len(frameMagic)+1] = schema
+	binary.BigEndian.PutUint32(data[len(frameMagic)+2:], frameChecksum(schema, payload))
+	return append(data, payload...)
+}
+
+// unmarshalFrame verify the frame and return the payload with its schema version,
+// the data without the frame magic is returned as it is, with schema version 0
+func unmarshalFrame(data []byte) ([]byte, uint8, error) {
+	if len(data) < len(frameMagic) || data[0] != frameMagic[0] || data[1] != frameMagic[1] {
+		return data, 0, nil
+	}
+	if len(data) < len(frameMagic)+1 {
+		return nil, 0, &corruptError{errors.New("frame is truncated")}
+	}
+
+	switch version := data[len(frameMagic)]; {
+	case version == 1:
+		if len(data) < frameV1HeaderSize {
+			return nil, 0, &corruptError{errors.New("frame is truncated")}
+		}
+		payload := data[frameV1HeaderSize:]
+		if binary.BigEndian.Uint32(data[len(frameMagic)+1:]) != crc32.Checksum(payload, crcTable) {
+			return nil, 0, &corruptError{errors.New("checksum mismatch")}
+		}
+		return payload, 1, nil
+	case version == frameVersion:
+		if len(data) < frameHeaderSize {
+			return nil, 0, &corruptError{errors.New("frame is truncated")}
+		}
+		schema, payload := data[len(frameMagic)+1], data[frameHeaderSize:]
+		if binary.BigEndian.Uint32(data[len(frameMagic)+2:]) != frameChecksum(schema, payload) {
+			return nil, 0, &corruptError{errors.New("checksum mismatch")}
+		}
+		return payload, schema, nil
+	case version > frameVersion:
+		// written by a newer release sharing the store
+		return nil, 0, ErrUnknownVersion
+	default:
+		return nil, 0, &corruptError{errors.New("unknown frame version")}
+	}
+}
+
+func frameChecksum(schema uint8, payload []byte) uint32 {
+	return crc32.Update(crc32.Checksum([]byte{schema}, crcTable), crcTable, payload)
+}
@@ -0,0 +1,89 @@
+package wcache
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// HeaderPolicy decide how the cached headers merge with the ones already set by earlier middleware
+type HeaderPolicy int
+
+const (
+	// HeaderPolicyOverwrite the cached values replace the existing ones, it is the default policy
+	HeaderPolicyOverwrite HeaderPolicy = iota
+	// HeaderPolicyKeep the existing values are kept, the cached ones are used only if absent
+	HeaderPolicyKeep
+	// HeaderPolicyAppend the cached values are appended to the existing ones, duplicates are skipped
+	HeaderPolicyAppend
+)
+
+// hopByHopHeaders the headers meaningful only for a single transport-level connection,
+// which must not be replayed from cache, see RFC 7230 section 6.1
+var hopByHopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// replayHeader merge the cached header into dst by policy, multi-values are preserved
+// and hop-by-hop headers, including the ones listed in Connection, are excluded
+func replayHeader(dst, cached http.Header, policy HeaderPolicy) {
+	var connection map[string]bool
+	for _, value := range cached["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				if connection == nil {
+					connection = make(map[string]bool)
+				}
+				connection[textproto.CanonicalMIMEHeaderKey(token)] = true
+			}
+		}
+	}
+
+	// the values are copied into a single block, so the cached ones are never touched
+	// by the later changes of dst, with one allocation per response
+	n := 0
+	for _, values := range cached {
+		n += len(values)
+	}
+	block := make([]string, 0, n)
+
+	for key, values := range cached {
+		key = textproto.CanonicalMIMEHeaderKey(key)
+		if hopByHopHeaders[key] || connection[key] {
+			continue
+		}
+
+		existing, ok := dst[key]
+		switch {
+		case !ok || policy == HeaderPolicyOverwrite:
+			// capped at the length, so an append to it never writes into the next key
+			start := len(block)
+			block = append(block, values...)
+			dst[key] = block[start:len(block):len(block)]
+		case policy == HeaderPolicyAppend:
+			for _, value := range values {
+				if !containsString(existing, value) {
+					existing = append(existing, value)
+				}
+			}
+			dst[key] = existing
+		}
+	}
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
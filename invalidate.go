@@ -0,0 +1,114 @@
+package wcache
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wyy-go/wcache/persist"
+)
+
+// InvalidateOn a companion middleware of Cache for unsafe methods like PUT, PATCH or DELETE,
+// after the request succeed, it deletes the cache keys that the configured GenerateCacheKey
+// would produce for the related GET uris, and the related prefixes or tags if configured.
+// unlike Cache, the default handle calls the next handler in the chain.
+func InvalidateOn(opts ...Option) gin.HandlerFunc {
+	options := newOptions(append([]Option{WithHandle(func(c *gin.Context) { c.Next() })}, opts...)...)
+
+	return func(c *gin.Context) {
+		options.handle(c)
+		if isSucceeded(c) {
+			invalidate(c, options)
+		}
+	}
+}
+
+// isSucceeded report whether the request has been handled with 2xx status and not been aborted
+func isSucceeded(c *gin.Context) bool {
+	return !c.IsAborted() && c.Writer.Status() >= 200 && c.Writer.Status() < 300
+}
+
+// invalidate delete all cache keys related to the request
+func invalidate(c *gin.Context, options *Options) {
+	if keys := relatedCacheKeys(c, options); len(keys) > 0 {
+		if err := persist.DeleteMulti(options.store, keys...); err != nil {
+			options.logger.Errorf("delete cache keys error: %s, cache keys: %v", err, keys)
+		}
+	}
+
+	if options.invalidatePrefixes != nil {
+		if prefixes := options.invalidatePrefixes(c); len(prefixes) > 0 {
+			store, ok := options.store.(persist.PrefixDeleter)
+			if !ok {
+				options.logger.Errorf("cache store does not support deleting by prefix")
+			} else {
+				for _, prefix := range prefixes {
+					if err := store.DeletePrefix(prefix); err != nil {
+						options.logger.Errorf("delete cache prefix error: %s, prefix: %s", err, prefix)
+					}
+				}
+			}
+		}
+	}
+
+	if options.invalidateTags != nil {
+		if tags := options.invalidateTags(c); len(tags) > 0 {
+			store, ok := options.store.(persist.TagStore)
+			if !ok {
+				options.logger.Errorf("cache store does not support tags")
+			} else if err := store.InvalidateTags(tags...); err != nil {
+				options.logger.Errorf("invalidate cache tags error: %s, tags: %v", err, tags)
+			}
+		}
+	}
+}
+
+// relatedCacheKeys generate the cache keys of the related GET uris, default is the request itself
+func relatedCacheKeys(c *gin.Context, options *Options) []string {
+	if options.invalidateURIs == nil {
+		if key, shouldCache := options.generateCacheKey(c); shouldCache {
+			return []string{key}
+		}
+		return nil
+	}
+
+	uris := options.invalidateURIs(c)
+	keys := make([]string, 0, len(uris))
+	for _, uri := range uris {
+		req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, uri, nil)
+		if err != nil {
+			options.logger.Errorf("invalid uri to invalidate: %s, uri: %s", err, uri)
+			continue
+		}
+		req.RequestURI = uri
+		req.Host = c.Request.Host
+
+		// the copy keeps params and keys, so custom key generators still work
+		cp := c.Copy()
+		cp.Request = req
+		if key, shouldCache := options.generateCacheKey(cp); shouldCache {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// tagCacheKey attach the cache key to the tags of the request
+func tagCacheKey(c *gin.Context, options *Options, cacheKey string, expire time.Duration) {
+	if options.tags == nil {
+		return
+	}
+	tags := options.tags(c)
+	if len(tags) == 0 {
+		return
+	}
+
+	store, ok := options.store.(persist.TagStore)
+	if !ok {
+		options.logger.Errorf("cache store does not support tags")
+		return
+	}
+	if err := store.AddTags(cacheKey, tags, expire); err != nil {
+		options.logger.Errorf("add cache tags error: %s, cache key: %s", err, cacheKey)
+	}
+}
@@ -0,0 +1,118 @@
+package wcache
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wyy-go/wcache/persist"
+)
+
+// LockFenceKey the key of the fencing token in gin.Context, set while rendering under the distributed lock,
+// the handlers can pass it to the systems they write to, so that a stale holder can be rejected
+const LockFenceKey = "wcache.lock.fence"
+
+// DistributedLock configure rendering a missing entry across instances by a persist.Locker, e.g. a
+// RedisStore. the instance which acquires the lock renders, the others poll the store for the entry,
+// and render it anyway after Wait, in case the holder fails. when the locker is the store itself and
+// implements persist.FencedSetter, as RedisStore does, the write of the holder is fenced, so that a
+// holder whose lease has expired during the render can not overwrite the entry of the next holder.
+type DistributedLock struct {
+	// TTL the lease of the lock, it should cover the render, default is 10s
+	TTL time.Duration
+	// Wait the max time to wait for the entry rendered by another instance, default is TTL
+	Wait time.Duration
+	// PollInterval the interval of polling the store for the entry, default is 50ms
+	PollInterval time.Duration
+}
+
+func (l DistributedLock) ttl() time.Duration {
+	if l.TTL > 0 {
+		return l.TTL
+	}
+	return 10 * time.Second
+}
+
+func (l DistributedLock) wait() time.Duration {
+	if l.Wait > 0 {
+		return l.Wait
+	}
+	return l.ttl()
+}
+
+func (l DistributedLock) pollInterval() time.Duration {
+	if l.PollInterval > 0 {
+		return l.PollInterval
+	}
+	return 50 * time.Millisecond
+}
+
+// renderLocked render the response as renderCache while holding the distributed lock of cacheKey if any.
+// if the lock is held by another instance, return the entry it renders if wait, fromStore reports that,
+// or nil if not wait. the response is rendered without the lock if the locker fails.
+func renderLocked(c *gin.Context, options *Options, cacheKey string, wait bool) (respCache *ResponseCache, fromStore bool) {
+	if options.locker == nil {
+		return renderCache(c, options, cacheKey, nil), false
+	}
+
+	lease, err := options.locker.TryLock(cacheKey, options.lock.ttl())
+	switch {
+	case err == nil:
+		defer func() {
+			if err := lease.Release(); err != nil {
+				options.logger.Errorf("release cache lock error: %s, cache key: %s", err, cacheKey)
+			}
+		}()
+		c.Set(LockFenceKey, lease.Fence())
+		return renderCache(c, options, cacheKey, lease), false
+	case errors.Is(err, persist.ErrLocked):
+		if !wait {
+			return nil, false
+		}
+		if respCache := waitCache(c, options, cacheKey); respCache != nil {
+			return respCache, true
+		}
+	default:
+		options.logger.Errorf("acquire cache lock error: %s, cache key: %s", err, cacheKey)
+	}
+	return renderCache(c, options, cacheKey, nil), false
+}
+
+// setCache set the response to the store, if the lease is given and the locker is the store itself
+// implementing persist.FencedSetter, only while the lease is the latest holder of the lock
+func setCache(options *Options, cacheKey string, respCache *ResponseCache, expire time.Duration, lease persist.Lease) error {
+	if lease != nil && options.fencedSetter != nil {
+		return options.fencedSetter.SetFenced(cacheKey, respCache, expire, lease.Fence())
+	}
+	return options.store.Set(cacheKey, respCache, expire)
+}
+
+// waitCache poll the store for the entry rendered by another instance, return nil if it does not
+// show up in time, the request is gone or the store fails
+func waitCache(c *gin.Context, options *Options, cacheKey string) *ResponseCache {
+	timer := time.NewTimer(options.lock.wait())
+	defer timer.Stop()
+	ticker := time.NewTicker(options.lock.pollInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// not from the pool, as it is shared by the requests in the singleflight
+			respCache := &ResponseCache{Header: make(http.Header), encode: options.encode}
+			err := options.store.Get(cacheKey, respCache)
+			if err == nil {
+				return respCache
+			}
+			if !errors.Is(err, persist.ErrCacheMiss) {
+				options.logger.Errorf("get cache error: %s, cache key: %s", err, cacheKey)
+				return nil
+			}
+		case <-timer.C:
+			return nil
+		case <-c.Request.Context().Done():
+			return nil
+		}
+	}
+}
@@ -3,6 +3,7 @@ package wcache
 import (
 	"github.com/wyy-go/wcache/persist"
 	"golang.org/x/sync/singleflight"
+	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -22,6 +23,22 @@ type Options struct {
 	pool                      Pool
 	encode                    Encoding
 	rand                      Rand
+	methods                   map[string]bool
+	maxBodySize               int64
+	headerPolicy              HeaderPolicy
+	compressors               []Compressor
+	corruptCallback           OnCorruptCallback
+	unknownVersionPolicy      UnknownVersionPolicy
+	invalidateOnUnsafeMethod  bool
+	tags                      GenerateRelated
+	invalidateURIs            GenerateRelated
+	invalidatePrefixes        GenerateRelated
+	invalidateTags            GenerateRelated
+	refreshAhead              *RefreshAhead
+	refresher                 *refresher
+	locker                    persist.Locker
+	lock                      DistributedLock
+	fencedSetter              persist.FencedSetter
 }
 
 // Option represents the optional function.
@@ -33,13 +50,54 @@ type OnHitCacheCallback func(c *gin.Context)
 // OnShareSingleFlightCallback define the callback when share the singleflight result
 type OnShareSingleFlightCallback func(c *gin.Context)
 
+// OnCorruptCallback define the callback when the cached data is corrupt, the key has been deleted
+type OnCorruptCallback func(c *gin.Context, key string, err error)
+
 type GenerateCacheKey func(c *gin.Context) (string, bool)
+
+// GenerateRelated generate the uris, prefixes or tags related to the request
+type GenerateRelated func(c *gin.Context) []string
 type Rand func() time.Duration
 
 var defaultRand = func() time.Duration { return 0 }
 var defaultHitCacheCallback = func(c *gin.Context) {}
 var defaultHandle = func(c *gin.Context) {}
 var defaultShareSingleFlightCallback = func(c *gin.Context) {}
+var defaultCorruptCallback = func(c *gin.Context, key string, err error) {}
+
+func newOptions(opts ...Option) *Options {
+	options := &Options{
+		logger:                    NewDiscard(),
+		hitCacheCallback:          defaultHitCacheCallback,
+		shareSingleFlightCallback: defaultShareSingleFlightCallback,
+		corruptCallback:           defaultCorruptCallback,
+		group:                     new(singleflight.Group),
+		store:                     nil,
+		expire:                    10 * time.Minute,
+		handle:                    defaultHandle,
+		generateCacheKey:          GenerateCacheKeyByURI,
+		pool:                      NewPool(),
+		encode:                    JSONEncoding{},
+		rand:                      defaultRand,
+		methods:                   map[string]bool{http.MethodGet: true},
+	}
+
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	if options.store == nil {
+		panic("you must set a cache store!")
+	}
+	// the fence of a lease is only known to the store which issued it
+	if store, ok := options.locker.(persist.CacheStore); ok && store == options.store {
+		options.fencedSetter, _ = options.locker.(persist.FencedSetter)
+	}
+	if options.refreshAhead != nil {
+		options.refresher = newRefresher(*options.refreshAhead, options.expire)
+	}
+	return options
+}
 
 // WithLogger set the custom logger
 func WithLogger(l Logger) Option {
@@ -68,6 +126,24 @@ func WithOnShareSingleFlight(cb OnShareSingleFlightCallback) Option {
 	}
 }
 
+// WithOnCorrupt will be called when the cached data is corrupt, such as truncated,
+// checksum mismatch or can not be decoded, the corrupt key has been deleted then.
+func WithOnCorrupt(cb OnCorruptCallback) Option {
+	return func(c *Options) {
+		if cb != nil {
+			c.corruptCallback = cb
+		}
+	}
+}
+
+// WithUnknownVersionPolicy set what to do with the cached data of an unknown future
+// schema version, default is UnknownVersionMiss.
+func WithUnknownVersionPolicy(policy UnknownVersionPolicy) Option {
+	return func(c *Options) {
+		c.unknownVersionPolicy = policy
+	}
+}
+
 // WithSingleFlightForgetTimeout to reduce the impact of long tail requests. when request in the singleflight,
 // after the forget timeout, singleflight.Forget will be called
 func WithSingleFlightForgetTimeout(forgetTimeout time.Duration) Option {
@@ -139,3 +215,120 @@ func WithRand(rand Rand) Option {
 		}
 	}
 }
+
+// WithMaxBodySize set the max size of the cacheable response body, 0 means no limit.
+// once the response exceeds it, the body is still streamed to the client, but it will
+// not be recorded nor cached, which caps the memory used per request.
+func WithMaxBodySize(size int64) Option {
+	return func(c *Options) {
+		if size >= 0 {
+			c.maxBodySize = size
+		}
+	}
+}
+
+// WithHeaderPolicy set how the cached headers merge with the ones already set
+// by earlier middleware, default is HeaderPolicyOverwrite.
+func WithHeaderPolicy(policy HeaderPolicy) Option {
+	return func(c *Options) {
+		c.headerPolicy = policy
+	}
+}
+
+// WithCompressors store the body pre-compressed, so that hits are served with
+// Content-Encoding directly if the client accepts it, and decompressed on the fly
+// otherwise. the first compressor is used for the stored body, the others are
+// stored as extra variants, e.g. WithCompressors(GzipCompressor{}, BrotliCompressor{}).
+// only the http content-codings gzip, deflate, br and zstd are accepted, it panics on others.
+// use it with a non-compressing Encoding to avoid compressing twice.
+func WithCompressors(compressors ...Compressor) Option {
+	for _, compressor := range compressors {
+		if !httpContentCodings[compressor.ContentEncoding()] {
+			panic("not an http content-coding of compressor: " + compressor.ContentEncoding())
+		}
+	}
+	return func(c *Options) {
+		c.compressors = compressors
+	}
+}
+
+// WithCacheableMethods set the methods whose response can be cached, default is GET only.
+// HEAD is always answered from the GET entry, and other methods bypass the cache.
+func WithCacheableMethods(methods ...string) Option {
+	return func(c *Options) {
+		if len(methods) > 0 {
+			c.methods = make(map[string]bool, len(methods))
+			for _, method := range methods {
+				c.methods[method] = true
+			}
+		}
+	}
+}
+
+// WithInvalidateOnUnsafeMethod delete the matching GET cache key after a request
+// with a method other than the cacheable ones or HEAD succeed on the same route, the related uris,
+// prefixes and tags configured for InvalidateOn are honored as well.
+func WithInvalidateOnUnsafeMethod(enable bool) Option {
+	return func(c *Options) {
+		c.invalidateOnUnsafeMethod = enable
+	}
+}
+
+// WithTags attach the cached response to tags, so that it can be invalidated by
+// WithInvalidateTags later. the store must implement persist.TagStore.
+func WithTags(f GenerateRelated) Option {
+	return func(c *Options) {
+		if f != nil {
+			c.tags = f
+		}
+	}
+}
+
+// WithInvalidateURIs set the GET uris whose cache keys will be deleted after a
+// successful unsafe request, default is the request uri itself.
+func WithInvalidateURIs(f GenerateRelated) Option {
+	return func(c *Options) {
+		if f != nil {
+			c.invalidateURIs = f
+		}
+	}
+}
+
+// WithInvalidatePrefixes set the key prefixes which will be deleted after a
+// successful unsafe request. the store must implement persist.PrefixDeleter.
+func WithInvalidatePrefixes(f GenerateRelated) Option {
+	return func(c *Options) {
+		if f != nil {
+			c.invalidatePrefixes = f
+		}
+	}
+}
+
+// WithInvalidateTags set the tags which will be invalidated after a successful
+// unsafe request. the store must implement persist.TagStore.
+func WithInvalidateTags(f GenerateRelated) Option {
+	return func(c *Options) {
+		if f != nil {
+			c.invalidateTags = f
+		}
+	}
+}
+
+// WithRefreshAhead re-render the popular entries in background before they expire,
+// see RefreshAhead for the thresholds, it is disabled by default.
+func WithRefreshAhead(config RefreshAhead) Option {
+	return func(c *Options) {
+		c.refreshAhead = &config
+	}
+}
+
+// WithDistributedLock render a missing entry by one instance only, the others wait for it in
+// the store, see DistributedLock. singleflight still dedupes the requests within the instance.
+func WithDistributedLock(locker persist.Locker, config DistributedLock) Option {
+	return func(c *Options) {
+		if locker != nil {
+			c.locker = locker
+			c.lock = config
+		}
+	}
+}
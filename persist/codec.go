@@ -0,0 +1,37 @@
+package persist
+
+import (
+	"encoding"
+	"encoding/json"
+)
+
+// Marshal encode the value for the stores which keep bytes only,
+// it prefers encoding.BinaryMarshaler, keeps string and []byte as is, and falls back to json
+func Marshal(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case encoding.BinaryMarshaler:
+		return v.MarshalBinary()
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return json.Marshal(value)
+	}
+}
+
+// Unmarshal decode the data encoded by Marshal into value, which must be a pointer
+func Unmarshal(data []byte, value interface{}) error {
+	switch v := value.(type) {
+	case encoding.BinaryUnmarshaler:
+		return v.UnmarshalBinary(data)
+	case *[]byte:
+		*v = append((*v)[:0], data...)
+		return nil
+	case *string:
+		*v = string(data)
+		return nil
+	default:
+		return json.Unmarshal(data, value)
+	}
+}
@@ -0,0 +1,318 @@
+package disk
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/wyy-go/wcache/persist"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	// entriesBucket key -> expire at in unix nano (0 is never) + value
+	entriesBucket = []byte("entries")
+	// expiryBucket expire at in unix nano (max is never) + key -> nothing, ordered by expiry
+	expiryBucket = []byte("expiry")
+)
+
+// ErrTooLarge represent the entry is larger than the size cap of the store
+var ErrTooLarge = errors.New("disk cache entry too large")
+
+// Options contains all options of DiskStore
+type Options struct {
+	compactInterval time.Duration
+	maxSize         int64
+	now             func() time.Time
+}
+
+// Option represents the optional function.
+type Option func(o *Options)
+
+// WithCompactInterval set the interval of removing the expired entries in background,
+// default is 1 minute, 0 disables it and the expired entries are only skipped on read
+func WithCompactInterval(interval time.Duration) Option {
+	return func(o *Options) {
+		o.compactInterval = interval
+	}
+}
+
+// WithMaxSize set the cap of the total size of keys and values in bytes, default is 0 (no cap).
+// on exceeding it, the expired entries are removed first, then the ones expiring soonest.
+func WithMaxSize(size int64) Option {
+	return func(o *Options) {
+		o.maxSize = size
+	}
+}
+
+// DiskStore store http response in an embedded bbolt file, which survives restarts.
+// the pages freed by the removed entries are reused by bbolt, the file itself never shrinks.
+type DiskStore struct {
+	DB *bbolt.DB
+
+	options Options
+
+	// mu serialize the writes, which bbolt does anyway, to keep size in step with the file
+	mu sync.Mutex
+	// size the total size of keys and values
+	size int64
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+var _ persist.CacheStore = (*DiskStore)(nil)
+
+// NewDiskStore open or create the bbolt file at path as a disk store,
+// the file is locked until Close, so it can not be shared by processes
+func NewDiskStore(path string, opts ...Option) (*DiskStore, error) {
+	options := Options{
+		compactInterval: time.Minute,
+		now:             time.Now,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	store := &DiskStore{
+		DB:      db,
+		options: options,
+		stop:    make(chan struct{}),
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		entries, err := tx.CreateBucketIfNotExists(entriesBucket)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists(expiryBucket); err != nil {
+			return err
+		}
+		return entries.ForEach(func(k, v []byte) error {
+			store.size += int64(len(k) + len(v))
+			return nil
+		})
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	if options.compactInterval > 0 {
+		store.wg.Add(1)
+		go store.compactLoop()
+	}
+	return store, nil
+}
+
+// Set put key value pair to disk store, and expire after expireDuration, 0 means never expire
+func (store *DiskStore) Set(key string, value interface{}, expireDuration time.Duration) error {
+	data, err := persist.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	var expireAt int64
+	if expireDuration > 0 {
+		expireAt = store.options.now().Add(expireDuration).UnixNano()
+	}
+	entry := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint64(entry, uint64(expireAt))
+	copy(entry[8:], data)
+
+	entrySize := int64(len(key) + len(entry))
+	if store.options.maxSize > 0 && entrySize > store.options.maxSize {
+		return ErrTooLarge
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var delta int64
+	err = store.DB.Update(func(tx *bbolt.Tx) error {
+		removed, err := store.remove(tx, []byte(key))
+		if err != nil {
+			return err
+		}
+		delta = entrySize - removed
+
+		if max := store.options.maxSize; max > 0 {
+			size := store.size + delta
+			if size > max {
+				freed, err := store.evict(tx, size-max)
+				if err != nil {
+					return err
+				}
+				delta -= freed
+			}
+		}
+
+		if err := tx.Bucket(entriesBucket).Put([]byte(key), entry); err != nil {
+			return err
+		}
+		return tx.Bucket(expiryBucket).Put(expiryKey(expireAt, []byte(key)), nil)
+	})
+	if err != nil {
+		return err
+	}
+	store.size += delta
+	return nil
+}
+
+// Delete remove key in disk store, do nothing if key doesn't exist
+func (store *DiskStore) Delete(key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var removed int64
+	err := store.DB.Update(func(tx *bbolt.Tx) error {
+		var err error
+		removed, err = store.remove(tx, []byte(key))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	store.size -= removed
+	return nil
+}
+
+// Get get key in disk store, if key doesn't exist or has expired, return ErrCacheMiss
+func (store *DiskStore) Get(key string, value interface{}) error {
+	var data []byte
+	err := store.DB.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(entriesBucket).Get([]byte(key))
+		if v == nil || store.isExpired(v) {
+			return persist.ErrCacheMiss
+		}
+		// the memory of v is only valid in the transaction
+		data = append([]byte(nil), v[8:]...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return persist.Unmarshal(data, value)
+}
+
+// Size return the total size of keys and values in bytes, including the expired ones not compacted yet
+func (store *DiskStore) Size() int64 {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.size
+}
+
+// Compact remove all expired entries
+func (store *DiskStore) Compact() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var freed int64
+	err := store.DB.Update(func(tx *bbolt.Tx) error {
+		now := uint64(store.options.now().UnixNano())
+		var keys [][]byte
+		c := tx.Bucket(expiryBucket).Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= now; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k[8:]...))
+		}
+		for _, key := range keys {
+			removed, err := store.remove(tx, key)
+			if err != nil {
+				return err
+			}
+			freed += removed
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	store.size -= freed
+	return nil
+}
+
+// Close stop the background compaction, and close the bbolt file
+func (store *DiskStore) Close() error {
+	store.once.Do(func() {
+		close(store.stop)
+	})
+	store.wg.Wait()
+	return store.DB.Close()
+}
+
+func (store *DiskStore) compactLoop() {
+	defer store.wg.Done()
+
+	ticker := time.NewTicker(store.options.compactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-store.stop:
+			return
+		case <-ticker.C:
+			_ = store.Compact()
+		}
+	}
+}
+
+// evict remove the entries expiring soonest until at least need bytes are freed
+func (store *DiskStore) evict(tx *bbolt.Tx, need int64) (int64, error) {
+	var keys [][]byte
+	var freed int64
+	entries := tx.Bucket(entriesBucket)
+	c := tx.Bucket(expiryBucket).Cursor()
+	for k, _ := c.First(); k != nil && freed < need; k, _ = c.Next() {
+		key := append([]byte(nil), k[8:]...)
+		keys = append(keys, key)
+		freed += int64(len(key) + len(entries.Get(key)))
+	}
+
+	for _, key := range keys {
+		if _, err := store.remove(tx, key); err != nil {
+			return 0, err
+		}
+	}
+	return freed, nil
+}
+
+// remove delete the entry and its expiry index, return the size freed
+func (store *DiskStore) remove(tx *bbolt.Tx, key []byte) (int64, error) {
+	entries := tx.Bucket(entriesBucket)
+	v := entries.Get(key)
+	if v == nil {
+		return 0, nil
+	}
+	size := int64(len(key) + len(v))
+	expireAt := int64(binary.BigEndian.Uint64(v))
+	if err := tx.Bucket(expiryBucket).Delete(expiryKey(expireAt, key)); err != nil {
+		return 0, err
+	}
+	if err := entries.Delete(key); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (store *DiskStore) isExpired(entry []byte) bool {
+	expireAt := int64(binary.BigEndian.Uint64(entry))
+	return expireAt != 0 && expireAt <= store.options.now().UnixNano()
+}
+
+// expiryKey the key of expiry index, the entries never expire are ordered last
+func expiryKey(expireAt int64, key []byte) []byte {
+	at := uint64(expireAt)
+	if expireAt == 0 {
+		at = math.MaxUint64
+	}
+	buf := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(buf, at)
+	copy(buf[8:], key)
+	return buf
+}
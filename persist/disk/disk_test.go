@@ -0,0 +1,226 @@
+package disk
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wyy-go/wcache/persist"
+)
+
+// fakeClock a clock which only moves forward by FastForward
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) FastForward(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func withClock(clock *fakeClock) Option {
+	return func(o *Options) {
+		o.now = clock.Now
+	}
+}
+
+func newDiskStore(t *testing.T, opts ...Option) (*DiskStore, *fakeClock) {
+	clock := &fakeClock{now: time.Now()}
+	path := filepath.Join(t.TempDir(), "cache.db")
+	store, err := NewDiskStore(path, append([]Option{withClock(clock)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store, clock
+}
+
+func TestDiskCache_TypicalGetSet(t *testing.T) {
+	var err error
+	cache, _ := newDiskStore(t)
+
+	value := "foo"
+	if err = cache.Set("value", value, time.Hour); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+
+	value = ""
+	err = cache.Get("value", &value)
+	if err != nil {
+		t.Errorf("Error getting a value: %s", err)
+	}
+	if value != "foo" {
+		t.Errorf("Expected to get foo back, got %s", value)
+	}
+}
+
+func TestDiskCache_Expiration(t *testing.T) {
+	var err error
+	cache, clock := newDiskStore(t)
+	value := 10
+
+	// Test Set w/ short time
+	if err := cache.Set("int", value, time.Second); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	clock.FastForward(2 * time.Second)
+	err = cache.Get("int", &value)
+	if err != persist.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss, but got: %s", err)
+	}
+	if err = cache.Delete("int"); err != nil {
+		t.Errorf("Expected nil for the expired key, but got: %s", err)
+	}
+
+	// Test Set w/ longer time.
+	if err := cache.Set("int", value, time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	clock.FastForward(2 * time.Second)
+	err = cache.Get("int", &value)
+	if err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+
+	// Test Set w/ forever.
+	if err := cache.Set("int", value, 0); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	clock.FastForward(365 * 24 * time.Hour)
+	err = cache.Get("int", &value)
+	if err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+}
+
+func TestDiskCache_EmptyCache(t *testing.T) {
+	var err error
+	cache, _ := newDiskStore(t)
+
+	err = cache.Get("notexist", time.Hour)
+	if err == nil {
+		t.Errorf("Error expected for non-existent key")
+	}
+	if err != persist.ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss for non-existent key: %s", err)
+	}
+
+	// do nothing if the key doesn't exist, as the CacheStore contract says
+	err = cache.Delete("notexist")
+	if err != nil {
+		t.Errorf("Expected nil for non-existent key: %s", err)
+	}
+}
+
+func TestDiskCache_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	cache, err := NewDiskStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("value", "foo", time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	size := cache.Size()
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = NewDiskStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	var value string
+	if err := cache.Get("value", &value); err != nil || value != "foo" {
+		t.Errorf("Expected to get foo back after reopen, got %s, %v", value, err)
+	}
+	if cache.Size() != size {
+		t.Errorf("Expected size %d after reopen, got %d", size, cache.Size())
+	}
+}
+
+func TestDiskCache_Compact(t *testing.T) {
+	cache, clock := newDiskStore(t, WithCompactInterval(0))
+
+	for _, key := range []string{"a", "b"} {
+		if err := cache.Set(key, key, time.Second); err != nil {
+			t.Errorf("wrong to set cache, but got: %s", err)
+		}
+	}
+	if err := cache.Set("c", "c", time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if err := cache.Set("d", "d", 0); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	full := cache.Size()
+
+	clock.FastForward(2 * time.Second)
+	if err := cache.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if want := full / 2; cache.Size() != want {
+		t.Errorf("Expected size %d after compaction, got %d", want, cache.Size())
+	}
+
+	var value string
+	for _, key := range []string{"c", "d"} {
+		if err := cache.Get(key, &value); err != nil || value != key {
+			t.Errorf("Expected to get %s back, got %s, %v", key, value, err)
+		}
+	}
+}
+
+func TestDiskCache_MaxSize(t *testing.T) {
+	// each entry is 1 byte key + 8 bytes expiry + 1 byte value
+	cache, _ := newDiskStore(t, WithMaxSize(30))
+
+	if err := cache.Set("a", "a", 0); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if err := cache.Set("b", "b", time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if err := cache.Set("c", "c", time.Minute); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	// overwriting does not count twice
+	if err := cache.Set("c", "c", time.Minute); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if cache.Size() != 30 {
+		t.Errorf("Expected size 30, got %d", cache.Size())
+	}
+
+	// c expires soonest, so it is evicted first
+	if err := cache.Set("d", "d", 2*time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if cache.Size() != 30 {
+		t.Errorf("Expected size 30, got %d", cache.Size())
+	}
+	var value string
+	if err := cache.Get("c", &value); err != persist.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss, but got: %s", err)
+	}
+	for _, key := range []string{"a", "b", "d"} {
+		if err := cache.Get(key, &value); err != nil {
+			t.Errorf("Expected to get %s back, but got: %s", key, err)
+		}
+	}
+
+	if err := cache.Set("large", "this value does not fit", 0); err != ErrTooLarge {
+		t.Errorf("Expected ErrTooLarge, but got: %v", err)
+	}
+}
@@ -0,0 +1,536 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wyy-go/wcache/persist"
+)
+
+const (
+	metaExt   = ".meta"
+	bodyExt   = ".body"
+	tmpPrefix = ".tmp-"
+
+	// metaVersion the version of meta file format
+	metaVersion = 1
+
+	// tmpGrace the age of a temporary file left by an interrupted write to be removed
+	tmpGrace = time.Hour
+)
+
+// neverExpire the mtime of the entries never expire, the far future time that
+// still fits the nanoseconds of the file times
+var neverExpire = time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ErrMetaFormat represent the meta file is malformed
+var ErrMetaFormat = errors.New("fs cache meta format error")
+
+// Options contains all options of FileStore
+type Options struct {
+	cleanupInterval time.Duration
+	quota           int64
+	now             func() time.Time
+}
+
+// Option represents the optional function.
+type Option func(o *Options)
+
+// WithCleanupInterval set the interval of removing the expired files in background,
+// default is 1 minute, 0 disables it and the expired entries are only skipped on read
+func WithCleanupInterval(interval time.Duration) Option {
+	return func(o *Options) {
+		o.cleanupInterval = interval
+	}
+}
+
+// WithQuota set the cap of the total size of files in bytes, default is 0 (no cap).
+// on exceeding it, the entries expiring soonest are removed until 90% of the quota is used.
+func WithQuota(quota int64) Option {
+	return func(o *Options) {
+		o.quota = quota
+	}
+}
+
+// FileStore store each entry as a meta file and a body file under a sharded directory tree.
+// a value implementing persist.BodySplitter, like the cached response, has its body written
+// as is, so that hits can be streamed from the file. the mtime of the files is the expire time,
+// the files are written to temporary files then renamed, so a reader never sees a partial one.
+type FileStore struct {
+	Dir string
+
+	options Options
+	// size the total size of the meta and body files
+	size int64
+	// locks serialize the writes of the keys in the same stripe, picked by the first byte of hash
+	locks    [256]sync.Mutex
+	evicting int32
+	seq      uint64
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+var _ persist.CacheStore = (*FileStore)(nil)
+var _ persist.BodyOpener = (*FileStore)(nil)
+
+// NewFileStore create a file store under dir, the existing entries are kept
+func NewFileStore(dir string, opts ...Option) (*FileStore, error) {
+	options := Options{
+		cleanupInterval: time.Minute,
+		now:             time.Now,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	store := &FileStore{
+		Dir:     dir,
+		options: options,
+		stop:    make(chan struct{}),
+	}
+	err := store.walk(func(path string, info os.FileInfo) {
+		if strings.HasPrefix(info.Name(), tmpPrefix) {
+			_ = os.Remove(path)
+			return
+		}
+		store.size += info.Size()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if options.cleanupInterval > 0 {
+		store.wg.Add(1)
+		go store.cleanupLoop()
+	}
+	return store, nil
+}
+
+// Set put key value pair to file store, and expire after expireDuration, 0 means never expire
+func (store *FileStore) Set(key string, value interface{}, expireDuration time.Duration) error {
+	var head, body []byte
+	var err error
+	splitter, split := value.(persist.BodySplitter)
+	if split {
+		head, body, err = splitter.SplitBody()
+	} else {
+		head, err = persist.Marshal(value)
+	}
+	if err != nil {
+		return err
+	}
+
+	expireAt := neverExpire
+	if expireDuration > 0 {
+		expireAt = store.options.now().Add(expireDuration)
+	}
+
+	hash := hashKey(key)
+	dir := store.shardDir(hash)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	delta, err := store.write(hash, dir, key, head, body, split, expireAt)
+	if err != nil {
+		return err
+	}
+	if size := atomic.AddInt64(&store.size, delta); store.options.quota > 0 && size > store.options.quota {
+		store.evict()
+	}
+	return nil
+}
+
+// write write the body file if split and the meta file of the entry, return the change of size
+func (store *FileStore) write(hash, dir, key string, head, body []byte, split bool, expireAt time.Time) (int64, error) {
+	lock := store.lock(hash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var bodyName string
+	var added int64
+	if split {
+		bodyName = hash + "." + strconv.FormatUint(atomic.AddUint64(&store.seq, 1), 36) +
+			strconv.FormatInt(store.options.now().UnixNano(), 36) + bodyExt
+		if err := writeFile(filepath.Join(dir, bodyName), body, expireAt); err != nil {
+			return 0, err
+		}
+		added += int64(len(body))
+	}
+
+	meta := encodeMeta(key, bodyName, head)
+	metaPath := filepath.Join(dir, hash+metaExt)
+	removed := store.entrySize(metaPath)
+	oldBody := store.bodyPath(metaPath)
+	if err := writeFile(metaPath, meta, expireAt); err != nil {
+		if bodyName != "" {
+			_ = os.Remove(filepath.Join(dir, bodyName))
+		}
+		return 0, err
+	}
+	added += int64(len(meta))
+	if oldBody != "" {
+		_ = os.Remove(oldBody)
+	}
+	return added - removed, nil
+}
+
+// Delete remove key in file store, do nothing if key doesn't exist
+func (store *FileStore) Delete(key string) error {
+	hash := hashKey(key)
+	lock := store.lock(hash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	metaPath := filepath.Join(store.shardDir(hash), hash+metaExt)
+	if _, err := os.Stat(metaPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return store.removeEntry(metaPath)
+}
+
+// Get get key in file store, if key doesn't exist or has expired, return ErrCacheMiss
+func (store *FileStore) Get(key string, value interface{}) error {
+	bodyPath, head, err := store.readMeta(key)
+	if err != nil {
+		return err
+	}
+
+	joiner, split := value.(persist.BodySplitter)
+	if !split || bodyPath == "" {
+		return persist.Unmarshal(head, value)
+	}
+	body, err := ioutil.ReadFile(bodyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// replaced or removed meanwhile
+			return persist.ErrCacheMiss
+		}
+		return err
+	}
+	return joiner.JoinBody(head, body)
+}
+
+// OpenBody get key in file store without loading the body, and open the body file
+func (store *FileStore) OpenBody(key string, value interface{}) (io.ReadSeekCloser, error) {
+	bodyPath, head, err := store.readMeta(key)
+	if err != nil {
+		return nil, err
+	}
+
+	joiner, split := value.(persist.BodySplitter)
+	if !split || bodyPath == "" {
+		return nil, persist.Unmarshal(head, value)
+	}
+	// the opened file stays readable even if it is replaced or removed later
+	body, err := os.Open(bodyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, persist.ErrCacheMiss
+		}
+		return nil, err
+	}
+	if err := joiner.JoinBody(head, nil); err != nil {
+		_ = body.Close()
+		return nil, err
+	}
+	return body, nil
+}
+
+// Size return the total size of files in bytes, including the expired ones not cleaned up yet
+func (store *FileStore) Size() int64 {
+	return atomic.LoadInt64(&store.size)
+}
+
+// Cleanup remove all expired files
+func (store *FileStore) Cleanup() error {
+	now := store.options.now()
+	return store.walk(func(path string, info os.FileInfo) {
+		name := info.Name()
+		if strings.HasPrefix(name, tmpPrefix) {
+			if info.ModTime().Before(now.Add(-tmpGrace)) {
+				_ = os.Remove(path)
+			}
+			return
+		}
+		if info.ModTime().After(now) {
+			return
+		}
+
+		lock := store.lock(name)
+		lock.Lock()
+		defer lock.Unlock()
+		// check again, it may have been replaced meanwhile
+		if info, err := os.Stat(path); err == nil && !info.ModTime().After(now) {
+			if err := os.Remove(path); err == nil {
+				atomic.AddInt64(&store.size, -info.Size())
+			}
+		}
+	})
+}
+
+// Close stop the background cleanup
+func (store *FileStore) Close() error {
+	store.once.Do(func() {
+		close(store.stop)
+	})
+	store.wg.Wait()
+	return nil
+}
+
+func (store *FileStore) cleanupLoop() {
+	defer store.wg.Done()
+
+	ticker := time.NewTicker(store.options.cleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-store.stop:
+			return
+		case <-ticker.C:
+			_ = store.Cleanup()
+		}
+	}
+}
+
+// evict remove the entries expiring soonest until 90% of the quota is used,
+// only one eviction runs at a time, the others skip it
+func (store *FileStore) evict() {
+	if !atomic.CompareAndSwapInt32(&store.evicting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&store.evicting, 0)
+
+	type entry struct {
+		path     string
+		expireAt time.Time
+	}
+	var entries []entry
+	_ = store.walk(func(path string, info os.FileInfo) {
+		if strings.HasSuffix(info.Name(), metaExt) {
+			entries = append(entries, entry{path: path, expireAt: info.ModTime()})
+		}
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].expireAt.Before(entries[j].expireAt)
+	})
+
+	target := store.options.quota / 10 * 9
+	for _, e := range entries {
+		if atomic.LoadInt64(&store.size) <= target {
+			return
+		}
+		lock := store.lock(filepath.Base(e.path))
+		lock.Lock()
+		_ = store.removeEntry(e.path)
+		lock.Unlock()
+	}
+}
+
+// readMeta read the meta file of key, return the path of body file if any, and the head
+func (store *FileStore) readMeta(key string) (string, []byte, error) {
+	hash := hashKey(key)
+	dir := store.shardDir(hash)
+	f, err := os.Open(filepath.Join(dir, hash+metaExt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil, persist.ErrCacheMiss
+		}
+		return "", nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	if store.isExpired(info) {
+		return "", nil, persist.ErrCacheMiss
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", nil, err
+	}
+
+	metaKey, bodyName, head, err := decodeMeta(data)
+	if err != nil {
+		return "", nil, err
+	}
+	if metaKey != key {
+		// hash collision
+		return "", nil, persist.ErrCacheMiss
+	}
+	if bodyName == "" {
+		return "", head, nil
+	}
+	return filepath.Join(dir, bodyName), head, nil
+}
+
+// removeEntry remove the meta file and its body file, the caller must hold the lock of the entry
+func (store *FileStore) removeEntry(metaPath string) error {
+	bodyPath := store.bodyPath(metaPath)
+	size := store.entrySize(metaPath)
+	if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if bodyPath != "" {
+		_ = os.Remove(bodyPath)
+	}
+	atomic.AddInt64(&store.size, -size)
+	return nil
+}
+
+// bodyPath return the path of body file referenced by the meta file, empty if none
+func (store *FileStore) bodyPath(metaPath string) string {
+	data, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		return ""
+	}
+	_, bodyName, _, err := decodeMeta(data)
+	if err != nil || bodyName == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(metaPath), bodyName)
+}
+
+// entrySize return the total size of the meta file and its body file, 0 if not exist
+func (store *FileStore) entrySize(metaPath string) int64 {
+	info, err := os.Stat(metaPath)
+	if err != nil {
+		return 0
+	}
+	size := info.Size()
+	if bodyPath := store.bodyPath(metaPath); bodyPath != "" {
+		if info, err := os.Stat(bodyPath); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+func (store *FileStore) isExpired(info os.FileInfo) bool {
+	return !info.ModTime().After(store.options.now())
+}
+
+// shardDir return the directory of the hash, two levels of 256 directories
+func (store *FileStore) shardDir(hash string) string {
+	return filepath.Join(store.Dir, hash[0:2], hash[2:4])
+}
+
+// lock return the lock of the stripe of the hash or a file name starting with it
+func (store *FileStore) lock(hash string) *sync.Mutex {
+	b, _ := strconv.ParseUint(hash[0:2], 16, 8)
+	return &store.locks[b]
+}
+
+// walk call fn with every regular file in the shard directories
+func (store *FileStore) walk(fn func(path string, info os.FileInfo)) error {
+	return filepath.Walk(store.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() && path != store.Dir {
+			name := info.Name()
+			if strings.HasPrefix(name, tmpPrefix) || len(name) > 2 && isHex(name[0:2]) {
+				fn(path, info)
+			}
+		}
+		return nil
+	})
+}
+
+// writeFile write data to a temporary file, set its mtime and rename it to path
+func writeFile(path string, data []byte, mtime time.Time) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), tmpPrefix)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, mtime, mtime)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// encodeMeta encode the meta file: version, key and body file name with uvarint length, and the head
+func encodeMeta(key, bodyName string, head []byte) []byte {
+	buf := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(key)+len(bodyName)+len(head))
+	buf = append(buf, metaVersion)
+	buf = appendString(buf, key)
+	buf = appendString(buf, bodyName)
+	return append(buf, head...)
+}
+
+func decodeMeta(data []byte) (key, bodyName string, head []byte, err error) {
+	if len(data) == 0 || data[0] != metaVersion {
+		return "", "", nil, ErrMetaFormat
+	}
+	r := bytes.NewReader(data[1:])
+	if key, err = readString(r); err != nil {
+		return "", "", nil, err
+	}
+	if bodyName, err = readString(r); err != nil {
+		return "", "", nil, err
+	}
+	return key, bodyName, data[len(data)-r.Len():], nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	var n [binary.MaxVarintLen64]byte
+	buf = append(buf, n[:binary.PutUvarint(n[:], uint64(len(s)))]...)
+	return append(buf, s...)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return "", ErrMetaFormat
+	}
+	s := make([]byte, n)
+	_, _ = r.Read(s)
+	return string(s), nil
+}
+
+func hashKey(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
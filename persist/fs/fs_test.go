@@ -0,0 +1,294 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wyy-go/wcache/persist"
+)
+
+// fakeClock a clock which only moves forward by FastForward
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) FastForward(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func withClock(clock *fakeClock) Option {
+	return func(o *Options) {
+		o.now = clock.Now
+	}
+}
+
+// page a value whose body is stored apart
+type page struct {
+	Title string
+	Body  []byte
+}
+
+func (p *page) SplitBody() ([]byte, []byte, error) {
+	return []byte(p.Title), p.Body, nil
+}
+
+func (p *page) JoinBody(head []byte, body []byte) error {
+	p.Title = string(head)
+	p.Body = body
+	return nil
+}
+
+func newFileStore(t *testing.T, opts ...Option) (*FileStore, *fakeClock) {
+	clock := &fakeClock{now: time.Now()}
+	store, err := NewFileStore(t.TempDir(), append([]Option{withClock(clock), WithCleanupInterval(0)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store, clock
+}
+
+func TestFileCache_TypicalGetSet(t *testing.T) {
+	var err error
+	cache, _ := newFileStore(t)
+
+	value := "foo"
+	if err = cache.Set("value", value, time.Hour); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+
+	value = ""
+	err = cache.Get("value", &value)
+	if err != nil {
+		t.Errorf("Error getting a value: %s", err)
+	}
+	if value != "foo" {
+		t.Errorf("Expected to get foo back, got %s", value)
+	}
+}
+
+func TestFileCache_Expiration(t *testing.T) {
+	var err error
+	cache, clock := newFileStore(t)
+	value := 10
+
+	// Test Set w/ short time
+	if err := cache.Set("int", value, time.Second); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	clock.FastForward(2 * time.Second)
+	err = cache.Get("int", &value)
+	if err != persist.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss, but got: %s", err)
+	}
+	if err = cache.Delete("int"); err != nil {
+		t.Errorf("Expected nil for the expired key, but got: %s", err)
+	}
+
+	// Test Set w/ longer time.
+	if err := cache.Set("int", value, time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	clock.FastForward(2 * time.Second)
+	err = cache.Get("int", &value)
+	if err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+
+	// Test Set w/ forever.
+	if err := cache.Set("int", value, 0); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	clock.FastForward(365 * 24 * time.Hour)
+	err = cache.Get("int", &value)
+	if err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+}
+
+func TestFileCache_EmptyCache(t *testing.T) {
+	var err error
+	cache, _ := newFileStore(t)
+
+	err = cache.Get("notexist", time.Hour)
+	if err == nil {
+		t.Errorf("Error expected for non-existent key")
+	}
+	if err != persist.ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss for non-existent key: %s", err)
+	}
+
+	// do nothing if the key doesn't exist, as the CacheStore contract says
+	err = cache.Delete("notexist")
+	if err != nil {
+		t.Errorf("Expected nil for non-existent key: %s", err)
+	}
+}
+
+func TestFileCache_Body(t *testing.T) {
+	cache, _ := newFileStore(t)
+
+	if err := cache.Set("page", &page{Title: "title", Body: []byte("first")}, time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if err := cache.Set("page", &page{Title: "title", Body: []byte("second")}, time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+
+	var p page
+	if err := cache.Get("page", &p); err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+	if p.Title != "title" || string(p.Body) != "second" {
+		t.Errorf("Expected to get title and second back, got %s and %s", p.Title, p.Body)
+	}
+
+	// the replaced body file has been removed
+	bodies, _ := filepath.Glob(filepath.Join(cache.Dir, "*", "*", "*"+bodyExt))
+	if len(bodies) != 1 {
+		t.Errorf("Expected 1 body file, got %v", bodies)
+	}
+
+	p = page{}
+	body, err := cache.OpenBody("page", &p)
+	if err != nil {
+		t.Fatalf("Expected to open the body, but got: %s", err)
+	}
+	defer body.Close()
+	data, _ := ioutil.ReadAll(body)
+	if p.Title != "title" || p.Body != nil || string(data) != "second" {
+		t.Errorf("Expected to get title and open second, got %s, %s and %s", p.Title, p.Body, data)
+	}
+
+	// the values not split are retrieved as a whole
+	if err := cache.Set("value", "foo", time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	var value string
+	if body, err := cache.OpenBody("value", &value); err != nil || body != nil || value != "foo" {
+		t.Errorf("Expected to get foo back without body, got %s, %v, %v", value, body, err)
+	}
+
+	if err := cache.Delete("page"); err != nil {
+		t.Errorf("wrong to delete cache, but got: %s", err)
+	}
+	if _, err := cache.OpenBody("page", &p); err != persist.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss, but got: %s", err)
+	}
+}
+
+func TestFileCache_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("page", &page{Title: "title", Body: []byte("body")}, time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	size := cache.Size()
+	_ = cache.Close()
+
+	// a temporary file left by an interrupted write
+	tmp := filepath.Join(dir, tmpPrefix+"1")
+	if err := ioutil.WriteFile(tmp, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	var p page
+	if err := cache.Get("page", &p); err != nil || string(p.Body) != "body" {
+		t.Errorf("Expected to get body back after reopen, got %s, %v", p.Body, err)
+	}
+	if cache.Size() != size {
+		t.Errorf("Expected size %d after reopen, got %d", size, cache.Size())
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary file removed, but got: %v", err)
+	}
+}
+
+func TestFileCache_Cleanup(t *testing.T) {
+	cache, clock := newFileStore(t)
+
+	if err := cache.Set("short", &page{Title: "short", Body: []byte("short")}, time.Second); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if err := cache.Set("long", &page{Title: "long", Body: []byte("long")}, time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if err := cache.Set("forever", "forever", 0); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	full := cache.Size()
+
+	clock.FastForward(2 * time.Second)
+	if err := cache.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if cache.Size() >= full {
+		t.Errorf("Expected size less than %d after cleanup, got %d", full, cache.Size())
+	}
+
+	files, _ := filepath.Glob(filepath.Join(cache.Dir, "*", "*", "*"))
+	if len(files) != 3 {
+		t.Errorf("Expected 3 files after cleanup, got %v", files)
+	}
+	var p page
+	if err := cache.Get("long", &p); err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+	var value string
+	if err := cache.Get("forever", &value); err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+}
+
+func TestFileCache_Quota(t *testing.T) {
+	body := []byte(strings.Repeat("x", 1000))
+	cache, _ := newFileStore(t, WithQuota(3500))
+
+	for i, key := range []string{"a", "b", "c"} {
+		if err := cache.Set(key, &page{Title: key, Body: body}, time.Duration(i+1)*time.Hour); err != nil {
+			t.Errorf("wrong to set cache, but got: %s", err)
+		}
+	}
+	if err := cache.Set("d", &page{Title: "d", Body: body}, time.Minute); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+
+	// d and a expire soonest, they are evicted to 90% of the quota
+	if cache.Size() > 3150 {
+		t.Errorf("Expected size within 90%% of quota, got %d", cache.Size())
+	}
+	var p page
+	for _, key := range []string{"d", "a"} {
+		if err := cache.Get(key, &p); err != persist.ErrCacheMiss {
+			t.Errorf("Expected CacheMiss of %s, but got: %v", key, err)
+		}
+	}
+	for _, key := range []string{"b", "c"} {
+		if err := cache.Get(key, &p); err != nil {
+			t.Errorf("Expected to get %s back, but got: %s", key, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package memcached
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/wyy-go/wcache/persist"
+)
+
+// maxRelativeExpiration memcached treats an expiration beyond 30 days as an absolute unix time
+const maxRelativeExpiration = 30 * 24 * time.Hour
+
+// maxKeyLength the max length of a memcached key
+const maxKeyLength = 250
+
+// MemcachedStore store http response in memcached
+type MemcachedStore struct {
+	Client *memcache.Client
+}
+
+var _ persist.CacheStore = (*MemcachedStore)(nil)
+
+// NewMemcachedStore create a memcached store with memcache client
+func NewMemcachedStore(client *memcache.Client) *MemcachedStore {
+	return &MemcachedStore{
+		Client: client,
+	}
+}
+
+// Set put key value pair to memcached, and expire after expireDuration
+func (store *MemcachedStore) Set(key string, value interface{}, expire time.Duration) error {
+	data, err := persist.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return store.Client.Set(&memcache.Item{
+		Key:        memcachedKey(key),
+		Value:      data,
+		Expiration: expiration(expire, time.Now()),
+	})
+}
+
+// Delete remove key in memcached, do nothing if key doesn't exist
+func (store *MemcachedStore) Delete(key string) error {
+	err := store.Client.Delete(memcachedKey(key))
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+// Get get key in memcached, if key doesn't exist, return ErrCacheMiss
+func (store *MemcachedStore) Get(key string, value interface{}) error {
+	item, err := store.Client.Get(memcachedKey(key))
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return persist.ErrCacheMiss
+		}
+		return err
+	}
+	return persist.Unmarshal(item.Value, value)
+}
+
+// expiration convert the duration to the memcached expiration in seconds, 0 means never expire.
+// a duration beyond 30 days is sent as an absolute unix time, the sub second one is rounded up.
+func expiration(expire time.Duration, now time.Time) int32 {
+	switch {
+	case expire == 0:
+		return 0
+	case expire < 0:
+		return -1
+	case expire > maxRelativeExpiration:
+		return int32(now.Add(expire).Unix())
+	default:
+		return int32((expire + time.Second - 1) / time.Second)
+	}
+}
+
+// memcachedKey hash the key longer than memcached allows, or with the bytes it rejects, such as the
+// control characters and spaces in the binary digest of CacheKeyWithPrefix, keeping its legal head readable
+func memcachedKey(key string) string {
+	legal := 0
+	for legal < len(key) && legalKeyByte(key[legal]) {
+		legal++
+	}
+	if legal == len(key) && len(key) <= maxKeyLength {
+		return key
+	}
+
+	head := key[:legal]
+	if max := maxKeyLength - 2*sha1.Size - 1; len(head) > max {
+		head = head[:max]
+	}
+	sum := sha1.Sum([]byte(key))
+	return head + ":" + hex.EncodeToString(sum[:])
+}
+
+// legalKeyByte report whether memcached accepts the byte in a key
+func legalKeyByte(b byte) bool {
+	return b > ' ' && b != 0x7f
+}
@@ -0,0 +1,346 @@
+package memcached
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/wyy-go/wcache/persist"
+)
+
+// fakeMemcached an in-process stand-in of memcached, speaking the text protocol
+// with get, gets, set and delete, and a clock which can be moved forward
+type fakeMemcached struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	now   time.Time
+	items map[string]fakeItem
+	// exptimes the raw exptime of the last set of each key
+	exptimes map[string]int64
+}
+
+type fakeItem struct {
+	flags    uint32
+	value    []byte
+	expireAt time.Time
+}
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeMemcached{
+		listener: l,
+		now:      time.Now(),
+		items:    make(map[string]fakeItem),
+		exptimes: make(map[string]int64),
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeMemcached) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeMemcached) FastForward(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = s.now.Add(d)
+}
+
+func (s *fakeMemcached) Exptime(key string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exptimes[key]
+}
+
+func (s *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "get", "gets":
+			s.get(rw, fields[1:])
+		case "set":
+			if err := s.set(rw, fields[1:]); err != nil {
+				return
+			}
+		case "delete":
+			s.delete(rw, fields[1])
+		default:
+			fmt.Fprintf(rw, "ERROR\r\n")
+		}
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeMemcached) get(w io.Writer, keys []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		item, ok := s.items[key]
+		if !ok || (!item.expireAt.IsZero() && !s.now.Before(item.expireAt)) {
+			continue
+		}
+		fmt.Fprintf(w, "VALUE %s %d %d 0\r\n%s\r\n", key, item.flags, len(item.value), item.value)
+	}
+	fmt.Fprintf(w, "END\r\n")
+}
+
+func (s *fakeMemcached) set(rw *bufio.ReadWriter, args []string) error {
+	flags, _ := strconv.ParseUint(args[1], 10, 32)
+	exptime, _ := strconv.ParseInt(args[2], 10, 64)
+	size, _ := strconv.Atoi(args[3])
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(rw, data); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item := fakeItem{flags: uint32(flags), value: data[:size]}
+	switch {
+	case exptime < 0:
+		item.expireAt = s.now
+	case exptime > int64(maxRelativeExpiration/time.Second):
+		item.expireAt = time.Unix(exptime, 0)
+	case exptime > 0:
+		item.expireAt = s.now.Add(time.Duration(exptime) * time.Second)
+	}
+	s.items[args[0]] = item
+	s.exptimes[args[0]] = exptime
+	fmt.Fprintf(rw, "STORED\r\n")
+	return nil
+}
+
+func (s *fakeMemcached) delete(w io.Writer, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[key]; !ok {
+		fmt.Fprintf(w, "NOT_FOUND\r\n")
+		return
+	}
+	delete(s.items, key)
+	fmt.Fprintf(w, "DELETED\r\n")
+}
+
+func newMemcachedStore(t *testing.T) (*MemcachedStore, *fakeMemcached) {
+	s := newFakeMemcached(t)
+	return NewMemcachedStore(memcache.New(s.Addr())), s
+}
+
+func TestMemcachedCache_TypicalGetSet(t *testing.T) {
+	var err error
+	cache, _ := newMemcachedStore(t)
+
+	value := "foo"
+	if err = cache.Set("value", value, time.Hour); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+
+	value = ""
+	err = cache.Get("value", &value)
+	if err != nil {
+		t.Errorf("Error getting a value: %s", err)
+	}
+	if value != "foo" {
+		t.Errorf("Expected to get foo back, got %s", value)
+	}
+}
+
+func TestMemcachedCache_Expiration(t *testing.T) {
+	var err error
+	cache, mc := newMemcachedStore(t)
+	value := 10
+
+	// Test Set w/ short time
+	if err := cache.Set("int", value, time.Second); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	mc.FastForward(2 * time.Second)
+	err = cache.Get("int", &value)
+	if err != persist.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss, but got: %s", err)
+	}
+
+	// Test Set w/ longer time.
+	if err := cache.Set("int", value, time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	mc.FastForward(2 * time.Second)
+	err = cache.Get("int", &value)
+	if err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+	if value != 10 {
+		t.Errorf("Expected to get 10 back, got %d", value)
+	}
+
+	// Test Set w/ forever.
+	if err := cache.Set("int", value, 0); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	mc.FastForward(365 * 24 * time.Hour)
+	err = cache.Get("int", &value)
+	if err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+}
+
+func TestMemcachedCache_LongExpiration(t *testing.T) {
+	cache, mc := newMemcachedStore(t)
+
+	// beyond 30 days, the expiration is sent as an absolute unix time
+	expire := 40 * 24 * time.Hour
+	before := time.Now().Add(expire).Unix()
+	if err := cache.Set("long", "foo", expire); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	after := time.Now().Add(expire).Unix()
+	if exptime := mc.Exptime("long"); exptime < before || exptime > after {
+		t.Errorf("Expected an absolute exptime in [%d, %d], got %d", before, after, exptime)
+	}
+
+	var value string
+	mc.FastForward(39 * 24 * time.Hour)
+	if err := cache.Get("long", &value); err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+	mc.FastForward(2 * 24 * time.Hour)
+	if err := cache.Get("long", &value); err != persist.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss, but got: %s", err)
+	}
+
+	// exactly 30 days is still relative
+	if err := cache.Set("month", "foo", maxRelativeExpiration); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if exptime := mc.Exptime("month"); exptime != int64(maxRelativeExpiration/time.Second) {
+		t.Errorf("Expected a relative exptime, got %d", exptime)
+	}
+}
+
+func TestMemcachedCache_EmptyCache(t *testing.T) {
+	var err error
+	cache, _ := newMemcachedStore(t)
+
+	err = cache.Get("notexist", time.Hour)
+	if err == nil {
+		t.Errorf("Error expected for non-existent key")
+	}
+	if err != persist.ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss for non-existent key: %s", err)
+	}
+
+	// do nothing if the key doesn't exist, as the CacheStore contract says
+	err = cache.Delete("notexist")
+	if err != nil {
+		t.Errorf("Expected nil for non-existent key: %s", err)
+	}
+}
+
+func TestMemcachedCache_LongKey(t *testing.T) {
+	cache, _ := newMemcachedStore(t)
+
+	long := strings.Repeat("k", 300)
+	if err := cache.Set(long, "foo", time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if err := cache.Set(long+"2", "bar", time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+
+	var value string
+	if err := cache.Get(long, &value); err != nil || value != "foo" {
+		t.Errorf("Expected to get foo back, got %s, %v", value, err)
+	}
+	if err := cache.Delete(long); err != nil {
+		t.Errorf("wrong to delete cache, but got: %s", err)
+	}
+	if err := cache.Get(long+"2", &value); err != nil || value != "bar" {
+		t.Errorf("Expected to get bar back, got %s, %v", value, err)
+	}
+}
+
+func TestMemcachedCache_BinaryKey(t *testing.T) {
+	cache, _ := newMemcachedStore(t)
+
+	// the keys of long uris end with the raw sha1 digest, as CacheKeyWithPrefix makes them
+	var keys []string
+	for i := 0; i < 20; i++ {
+		sum := sha1.Sum([]byte(fmt.Sprintf("/%s/%d", strings.Repeat("x", 200), i)))
+		keys = append(keys, "wcache.page.cache:"+string(sum[:]))
+	}
+	keys = append(keys, "with space", "with\x00nul", "with\x7fdel")
+
+	for i, key := range keys {
+		if err := cache.Set(key, strconv.Itoa(i), time.Hour); err != nil {
+			t.Errorf("wrong to set cache %q, but got: %s", key, err)
+		}
+	}
+	var value string
+	for i, key := range keys {
+		if err := cache.Get(key, &value); err != nil || value != strconv.Itoa(i) {
+			t.Errorf("Expected to get %d back of %q, got %s, %v", i, key, value, err)
+		}
+	}
+	if err := cache.Delete(keys[0]); err != nil {
+		t.Errorf("wrong to delete cache, but got: %s", err)
+	}
+	if err := cache.Get(keys[0], &value); err != persist.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss, but got: %v", err)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	cases := []struct {
+		expire time.Duration
+		want   int32
+	}{
+		{0, 0},
+		{-time.Second, -1},
+		{time.Millisecond, 1},
+		{1500 * time.Millisecond, 2},
+		{time.Hour, 3600},
+		{maxRelativeExpiration, 2592000},
+		{maxRelativeExpiration + time.Second, 1600000000 + 2592001},
+	}
+	for _, c := range cases {
+		if got := expiration(c.expire, now); got != c.want {
+			t.Errorf("expiration(%s) = %d, want %d", c.expire, got, c.want)
+		}
+	}
+}
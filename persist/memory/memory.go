@@ -4,6 +4,9 @@ import (
 	"errors"
 	"github.com/wyy-go/wcache/persist"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ReneKroon/ttlcache/v2"
@@ -12,26 +15,118 @@ import (
 // MemoryStore local memory cache store
 type MemoryStore struct {
 	Cache *ttlcache.Cache
+
+	// tagsMu guard tags and keyTags, it is taken within the expiration of Cache,
+	// so Cache must not be called while holding it
+	tagsMu  sync.Mutex
+	tags    map[string]map[string]struct{}
+	keyTags map[string]map[string]struct{}
+
+	options           Options
+	defaultExpiration time.Duration
+	// entries shadow the *entry set by key for Exists, TTL and Snapshot,
+	// as reading them back from Cache would extend their ttl
+	entries sync.Map
+	// keyLocks the striped locks of keys, Cache and entries of a key are written under one
+	keyLocks [keyLockStripes]sync.Mutex
+}
+
+// keyLockStripes the number of the striped locks of keys
+const keyLockStripes = 64
+
+// entry a value set with its expire time, which is extended by the hits like in Cache
+type entry struct {
+	value interface{}
+	// ttl the duration extended on hit, non-positive means never expire
+	ttl time.Duration
+	// expireAt the expire time in unix nanoseconds, accessed atomically
+	expireAt int64
 }
 
+// Options contains all options of MemoryStore
+type Options struct {
+	encoding     Encoding
+	snapshotFile string
+}
+
+// Option represents the optional function.
+type Option func(o *Options)
+
+// WithEncoding set the encoding of the values in snapshot, e.g. an Encoding of wcache,
+// default is the MarshalBinary of the value, or JSON if not implemented
+func WithEncoding(encoding Encoding) Option {
+	return func(o *Options) {
+		o.encoding = encoding
+	}
+}
+
+// WithSnapshotFile restore the store from the snapshot file at start if it exists, and save
+// the snapshot to it on Close, so that a restart keeps the cache warm. a snapshot which can
+// not be restored is ignored, call LoadSnapshotFile instead to handle the error.
+func WithSnapshotFile(path string) Option {
+	return func(o *Options) {
+		o.snapshotFile = path
+	}
+}
+
+var _ persist.TagStore = (*MemoryStore)(nil)
+var _ persist.Loader = (*MemoryStore)(nil)
+var _ persist.Exister = (*MemoryStore)(nil)
+var _ persist.TTLer = (*MemoryStore)(nil)
+var _ persist.Toucher = (*MemoryStore)(nil)
+var _ persist.Clearer = (*MemoryStore)(nil)
+var _ persist.KeyScanner = (*MemoryStore)(nil)
+var _ persist.PrefixDeleter = (*MemoryStore)(nil)
+var _ persist.MultiGetter = (*MemoryStore)(nil)
+var _ persist.MultiSetter = (*MemoryStore)(nil)
+var _ persist.MultiDeleter = (*MemoryStore)(nil)
+
 // NewMemoryStore allocate a local memory store with default expiration
-func NewMemoryStore(defaultExpiration time.Duration) *MemoryStore {
+func NewMemoryStore(defaultExpiration time.Duration, opts ...Option) *MemoryStore {
 	cacheStore := ttlcache.NewCache()
 	_ = cacheStore.SetTTL(defaultExpiration)
 
-	return &MemoryStore{
-		Cache: cacheStore,
+	store := &MemoryStore{
+		Cache:             cacheStore,
+		tags:              make(map[string]map[string]struct{}),
+		keyTags:           make(map[string]map[string]struct{}),
+		defaultExpiration: defaultExpiration,
+	}
+	for _, opt := range opts {
+		opt(&store.options)
+	}
+	// drop the expired keys from the entries and tags, it is called before the key is removed from Cache
+	cacheStore.SetCheckExpirationCallback(func(key string, _ interface{}) bool {
+		store.entries.Delete(key)
+		store.untag(key)
+		return true
+	})
+	if store.options.snapshotFile != "" {
+		_ = store.LoadSnapshotFile(store.options.snapshotFile)
 	}
+	return store
 }
 
 // Set put key value pair to memory store, and expire after expireDuration
 func (c *MemoryStore) Set(key string, value interface{}, expireDuration time.Duration) error {
-	return c.Cache.SetWithTTL(key, value, expireDuration)
+	return c.set(key, value, expireDuration)
+}
+
+// Close save the snapshot if WithSnapshotFile is set, and close the store
+func (c *MemoryStore) Close() error {
+	var err error
+	if c.options.snapshotFile != "" {
+		err = c.SaveSnapshotFile(c.options.snapshotFile)
+	}
+	if closeErr := c.Cache.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 // Delete remove key in memory store, do nothing if key doesn't exist
 func (c *MemoryStore) Delete(key string) error {
-	err := c.Cache.Remove(key)
+	err := c.remove(key)
 	if err != nil {
 		if errors.Is(err, ttlcache.ErrNotFound) {
 			return persist.ErrCacheMiss
@@ -39,7 +134,7 @@ func (c *MemoryStore) Delete(key string) error {
 		return err
 	}
 
-	return c.Cache.Remove(key)
+	return nil
 }
 
 // Get get key in memory store, if key doesn't exist, return ErrCacheMiss
@@ -51,11 +146,297 @@ func (c *MemoryStore) Get(key string, value interface{}) error {
 		}
 		return err
 	}
+	c.hit(key)
+
+	if raw, ok := val.(rawValue); ok {
+		// restored from snapshot, decoded on read as the type is unknown before
+		return c.unmarshal(raw, value)
+	}
+
+	copyValue(value, val)
+	return nil
+}
+
+// Load get key in memory store as it was set without copying, if key doesn't exist, return ErrCacheMiss.
+// the value restored from snapshot is returned encoded, as the type is unknown until Get.
+func (c *MemoryStore) Load(key string) (interface{}, error) {
+	val, err := c.Cache.Get(key)
+	if err != nil {
+		if errors.Is(err, ttlcache.ErrNotFound) {
+			return nil, persist.ErrCacheMiss
+		}
+		return nil, err
+	}
+	c.hit(key)
+	return val, nil
+}
+
+// GetMulti get keys in memory store, the errors are ErrCacheMiss for the keys don't exist
+func (c *MemoryStore) GetMulti(keys []string, values []interface{}) []error {
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		errs[i] = c.Get(key, values[i])
+	}
+	return errs
+}
+
+// SetMulti put key value pairs to memory store, and expire after expireDuration
+func (c *MemoryStore) SetMulti(keys []string, values []interface{}, expireDuration time.Duration) error {
+	if len(keys) != len(values) {
+		return persist.ErrMultiLength
+	}
+
+	for i, key := range keys {
+		if err := c.set(key, values[i], expireDuration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteMulti remove keys in memory store, the missing ones are skipped
+func (c *MemoryStore) DeleteMulti(keys ...string) error {
+	for _, key := range keys {
+		if err := c.remove(key); err != nil && !errors.Is(err, ttlcache.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// set put key value pair to Cache and entries together
+func (c *MemoryStore) set(key string, value interface{}, expireDuration time.Duration) error {
+	mu := c.keyLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := c.Cache.SetWithTTL(key, value, expireDuration); err != nil {
+		return err
+	}
+	c.setEntry(key, value, expireDuration)
+	return nil
+}
+
+// remove delete key from Cache, entries and tags together, return ttlcache.ErrNotFound if key doesn't exist
+func (c *MemoryStore) remove(key string) error {
+	mu := c.keyLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	c.entries.Delete(key)
+	c.untag(key)
+	return c.Cache.Remove(key)
+}
 
-	v := reflect.ValueOf(value)
+// keyLock return the striped lock of key
+func (c *MemoryStore) keyLock(key string) *sync.Mutex {
+	return &c.keyLocks[fnv32a(key)%keyLockStripes]
+}
+
+// copyValue set the value pointed by dst to src, the common types avoid reflection
+func copyValue(dst, src interface{}) {
+	switch d := dst.(type) {
+	case persist.Copier:
+		if d.CopyFrom(src) {
+			return
+		}
+	case *string:
+		if s, ok := src.(string); ok {
+			*d = s
+			return
+		}
+	case *[]byte:
+		if s, ok := src.([]byte); ok {
+			*d = s
+			return
+		}
+	}
+
+	v := reflect.ValueOf(dst)
 	if v.Type().Kind() == reflect.Ptr && v.Elem().CanSet() {
-		v.Elem().Set(reflect.Indirect(reflect.ValueOf(val)))
+		v.Elem().Set(reflect.Indirect(reflect.ValueOf(src)))
+	}
+}
+
+// setEntry record the value of key after it is set with expireDuration, the caller must hold the key lock
+func (c *MemoryStore) setEntry(key string, value interface{}, expireDuration time.Duration) {
+	if expireDuration == ttlcache.ItemExpireWithGlobalTTL {
+		expireDuration = c.defaultExpiration
+	}
+	e := &entry{value: value, ttl: expireDuration}
+	if expireDuration > 0 {
+		e.expireAt = time.Now().Add(expireDuration).UnixNano()
+	}
+	c.entries.Store(key, e)
+}
+
+// hit extend the expire time of key as Cache does on a hit
+func (c *MemoryStore) hit(key string) {
+	if v, ok := c.entries.Load(key); ok {
+		if e := v.(*entry); e.ttl > 0 {
+			atomic.StoreInt64(&e.expireAt, time.Now().Add(e.ttl).UnixNano())
+		}
+	}
+}
+
+// remaining return the remaining ttl of key, persist.NoExpiration if it never expires,
+// and report whether key exists
+func (c *MemoryStore) remaining(key string) (time.Duration, bool) {
+	v, ok := c.entries.Load(key)
+	if !ok {
+		return 0, false
+	}
+	e := v.(*entry)
+	if e.ttl <= 0 {
+		return persist.NoExpiration, true
+	}
+	ttl := time.Until(time.Unix(0, atomic.LoadInt64(&e.expireAt)))
+	return ttl, ttl > 0
+}
+
+// AddTags attach key to tags, the key is detached when it expires or is deleted
+func (c *MemoryStore) AddTags(key string, tags []string, _ time.Duration) error {
+	c.tagsMu.Lock()
+	defer c.tagsMu.Unlock()
+
+	c.addTags(key, tags)
+	return nil
+}
+
+// InvalidateTags remove all keys attached to tags
+func (c *MemoryStore) InvalidateTags(tags ...string) error {
+	for _, tag := range tags {
+		c.tagsMu.Lock()
+		keys := make([]string, 0, len(c.tags[tag]))
+		for key := range c.tags[tag] {
+			keys = append(keys, key)
+		}
+		for _, key := range keys {
+			c.untagLocked(key)
+		}
+		c.tagsMu.Unlock()
+
+		for _, key := range keys {
+			if err := c.remove(key); err != nil && !errors.Is(err, ttlcache.ErrNotFound) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addTags attach key to tags, the caller must hold tagsMu
+func (c *MemoryStore) addTags(key string, tags []string) {
+	for _, tag := range tags {
+		keys, ok := c.tags[tag]
+		if !ok {
+			keys = make(map[string]struct{})
+			c.tags[tag] = keys
+		}
+		keys[key] = struct{}{}
+
+		attached, ok := c.keyTags[key]
+		if !ok {
+			attached = make(map[string]struct{})
+			c.keyTags[key] = attached
+		}
+		attached[tag] = struct{}{}
+	}
+}
+
+// untag detach key from all its tags
+func (c *MemoryStore) untag(key string) {
+	c.tagsMu.Lock()
+	c.untagLocked(key)
+	c.tagsMu.Unlock()
+}
+
+// untagLocked detach key from all its tags, the caller must hold tagsMu
+func (c *MemoryStore) untagLocked(key string) {
+	for tag := range c.keyTags[key] {
+		delete(c.tags[tag], key)
+		if len(c.tags[tag]) == 0 {
+			delete(c.tags, tag)
+		}
+	}
+	delete(c.keyTags, key)
+}
+
+// DeletePrefix remove all keys start with prefix
+func (c *MemoryStore) DeletePrefix(prefix string) error {
+	for _, key := range c.Cache.GetKeys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if err := c.remove(key); err != nil && !errors.Is(err, ttlcache.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Exists report whether key exists in memory store, without extending the ttl of key
+func (c *MemoryStore) Exists(key string) (bool, error) {
+	_, ok := c.remaining(key)
+	return ok, nil
+}
+
+// TTL return the remaining ttl of key, without extending the ttl of key
+func (c *MemoryStore) TTL(key string) (time.Duration, error) {
+	ttl, ok := c.remaining(key)
+	if !ok {
+		return 0, persist.ErrCacheMiss
+	}
+	return ttl, nil
+}
+
+// Touch set key to expire after expireDuration, a non-positive one means never expire
+func (c *MemoryStore) Touch(key string, expireDuration time.Duration) error {
+	if expireDuration <= 0 {
+		expireDuration = ttlcache.ItemNotExpire
+	}
+
+	mu := c.keyLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	val, err := c.Cache.Get(key)
+	if err != nil {
+		if errors.Is(err, ttlcache.ErrNotFound) {
+			return persist.ErrCacheMiss
+		}
+		return err
+	}
+	if err := c.Cache.SetWithTTL(key, val, expireDuration); err != nil {
+		return err
 	}
+	c.setEntry(key, val, expireDuration)
+	return nil
+}
 
+// Clear remove all keys and tags in memory store
+func (c *MemoryStore) Clear() error {
+	if err := c.Cache.Purge(); err != nil {
+		return err
+	}
+	c.entries.Range(func(key, _ interface{}) bool {
+		c.entries.Delete(key)
+		return true
+	})
+	c.tagsMu.Lock()
+	c.tags = make(map[string]map[string]struct{})
+	c.keyTags = make(map[string]map[string]struct{})
+	c.tagsMu.Unlock()
 	return nil
 }
+
+// Keys return all keys start with prefix in memory store
+func (c *MemoryStore) Keys(prefix string) ([]string, error) {
+	var keys []string
+	for _, key := range c.Cache.GetKeys() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
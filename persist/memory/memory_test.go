@@ -1,7 +1,15 @@
 package memory
 
 import (
+	"bytes"
 	"github.com/wyy-go/wcache/persist"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"testing"
 	"time"
@@ -85,3 +93,657 @@ func TestInMemoryCache_EmptyCache(t *testing.T) {
 		t.Errorf("Expected ErrCacheMiss for non-existent key: %s", err)
 	}
 }
+
+func TestInMemoryCache_Tags(t *testing.T) {
+	cache := newInMemoryStore(t, time.Hour).(persist.TagStore)
+	store := cache.(persist.CacheStore)
+
+	for _, key := range []string{"tag1", "tag2", "tag3"} {
+		if err := store.Set(key, key, time.Hour); err != nil {
+			t.Errorf("wrong to set cache, but got: %s", err)
+		}
+	}
+	if err := cache.AddTags("tag1", []string{"a", "b"}, time.Hour); err != nil {
+		t.Errorf("wrong to add tags, but got: %s", err)
+	}
+	if err := cache.AddTags("tag2", []string{"b"}, time.Hour); err != nil {
+		t.Errorf("wrong to add tags, but got: %s", err)
+	}
+
+	if err := cache.InvalidateTags("b"); err != nil {
+		t.Errorf("wrong to invalidate tags, but got: %s", err)
+	}
+	var value string
+	for _, key := range []string{"tag1", "tag2"} {
+		if err := store.Get(key, &value); err != persist.ErrCacheMiss {
+			t.Errorf("Expected CacheMiss, but got: %s", err)
+		}
+	}
+	if err := store.Get("tag3", &value); err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+}
+
+func TestInMemoryCache_TagsPruned(t *testing.T) {
+	cache := NewMemoryStore(time.Hour)
+	defer cache.Close()
+
+	for _, key := range []string{"expired", "deleted", "multi", "prefix:1", "kept"} {
+		expire := time.Hour
+		if key == "expired" {
+			expire = 50 * time.Millisecond
+		}
+		if err := cache.Set(key, key, expire); err != nil {
+			t.Errorf("wrong to set cache, but got: %s", err)
+		}
+		if err := cache.AddTags(key, []string{"a", key}, expire); err != nil {
+			t.Errorf("wrong to add tags, but got: %s", err)
+		}
+	}
+	if err := cache.Delete("deleted"); err != nil {
+		t.Errorf("wrong to delete, but got: %s", err)
+	}
+	if err := cache.DeleteMulti("multi"); err != nil {
+		t.Errorf("wrong to delete multi, but got: %s", err)
+	}
+	if err := cache.DeletePrefix("prefix:"); err != nil {
+		t.Errorf("wrong to delete prefix, but got: %s", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	cache.tagsMu.Lock()
+	defer cache.tagsMu.Unlock()
+	want := map[string]map[string]struct{}{
+		"a":    {"kept": {}},
+		"kept": {"kept": {}},
+	}
+	if !reflect.DeepEqual(cache.tags, want) {
+		t.Errorf("Expected tags %v, but got: %v", want, cache.tags)
+	}
+	if len(cache.keyTags) != 1 {
+		t.Errorf("Expected the tags of kept only, but got: %v", cache.keyTags)
+	}
+}
+
+func TestInMemoryCache_DeletePrefix(t *testing.T) {
+	cache := newInMemoryStore(t, time.Hour)
+
+	for _, key := range []string{"prefix:1", "prefix:2", "other:1"} {
+		if err := cache.Set(key, key, time.Hour); err != nil {
+			t.Errorf("wrong to set cache, but got: %s", err)
+		}
+	}
+	if err := cache.(persist.PrefixDeleter).DeletePrefix("prefix:"); err != nil {
+		t.Errorf("wrong to delete prefix, but got: %s", err)
+	}
+
+	var value string
+	for _, key := range []string{"prefix:1", "prefix:2"} {
+		if err := cache.Get(key, &value); err != persist.ErrCacheMiss {
+			t.Errorf("Expected CacheMiss, but got: %s", err)
+		}
+	}
+	if err := cache.Get("other:1", &value); err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+}
+
+type snapshotValue struct {
+	Name  string
+	Count int
+}
+
+func TestInMemoryCache_Snapshot(t *testing.T) {
+	cache := NewMemoryStore(time.Hour)
+	defer cache.Close()
+
+	if err := cache.Set("string", "foo", time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if err := cache.Set("struct", &snapshotValue{Name: "bar", Count: 2}, -1); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if err := cache.Set("expired", "baz", time.Millisecond); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if err := cache.AddTags("string", []string{"a"}, time.Hour); err != nil {
+		t.Errorf("wrong to add tags, but got: %s", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := cache.Snapshot(&buf); err != nil {
+		t.Fatalf("wrong to snapshot, but got: %s", err)
+	}
+
+	restored := NewMemoryStore(time.Hour)
+	defer restored.Close()
+	if err := restored.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("wrong to restore, but got: %s", err)
+	}
+
+	var s string
+	if err := restored.Get("string", &s); err != nil || s != "foo" {
+		t.Errorf("Expected to get foo back, got %s, %v", s, err)
+	}
+	var v snapshotValue
+	if err := restored.Get("struct", &v); err != nil || v.Name != "bar" || v.Count != 2 {
+		t.Errorf("Expected to get bar back, got %+v, %v", v, err)
+	}
+	if err := restored.Get("expired", &s); err != persist.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss, but got: %v", err)
+	}
+
+	// the remaining ttl is kept, the entry set forever never expires
+	if _, ttl, err := restored.Cache.GetWithTTL("string"); err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("Expected the remaining ttl within an hour, got %s, %v", ttl, err)
+	}
+	if _, ttl, err := restored.Cache.GetWithTTL("struct"); err != nil || ttl > 0 {
+		t.Errorf("Expected never expire, got %s, %v", ttl, err)
+	}
+
+	// the tags are restored, a restored entry is snapshotted again as is
+	if err := restored.InvalidateTags("a"); err != nil {
+		t.Errorf("wrong to invalidate tags, but got: %s", err)
+	}
+	if err := restored.Get("string", &s); err != persist.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss, but got: %v", err)
+	}
+	buf.Reset()
+	if err := restored.Snapshot(&buf); err != nil {
+		t.Fatalf("wrong to snapshot, but got: %s", err)
+	}
+	again := NewMemoryStore(time.Hour)
+	defer again.Close()
+	if err := again.Restore(&buf); err != nil {
+		t.Fatalf("wrong to restore, but got: %s", err)
+	}
+	v = snapshotValue{}
+	if err := again.Get("struct", &v); err != nil || v.Name != "bar" {
+		t.Errorf("Expected to get bar back, got %+v, %v", v, err)
+	}
+
+	if err := again.Restore(strings.NewReader("not a snapshot")); err != ErrSnapshotFormat {
+		t.Errorf("Expected ErrSnapshotFormat, but got: %v", err)
+	}
+}
+
+func TestInMemoryCache_SnapshotRestoreLater(t *testing.T) {
+	cache := NewMemoryStore(time.Hour)
+	defer cache.Close()
+
+	if err := cache.Set("short", "short", 100*time.Millisecond); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if err := cache.Set("long", "long", 500*time.Millisecond); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if err := cache.AddTags("short", []string{"a"}, time.Hour); err != nil {
+		t.Errorf("wrong to add tags, but got: %s", err)
+	}
+	var buf bytes.Buffer
+	if err := cache.Snapshot(&buf); err != nil {
+		t.Fatalf("wrong to snapshot, but got: %s", err)
+	}
+
+	// the process is down for a while before the restore
+	time.Sleep(200 * time.Millisecond)
+	restored := NewMemoryStore(time.Hour)
+	defer restored.Close()
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatalf("wrong to restore, but got: %s", err)
+	}
+
+	// the expire time is kept, not the remaining ttl at the snapshot
+	var s string
+	if err := restored.Get("short", &s); err != persist.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss of the entry expired while down, but got: %v", err)
+	}
+	if ttl, err := restored.TTL("long"); err != nil || ttl <= 0 || ttl > 300*time.Millisecond {
+		t.Errorf("Expected the ttl under 300ms, got %s, %v", ttl, err)
+	}
+	restored.tagsMu.Lock()
+	defer restored.tagsMu.Unlock()
+	if len(restored.tags) != 0 {
+		t.Errorf("Expected no tags of the expired entry, but got: %v", restored.tags)
+	}
+}
+
+func TestInMemoryCache_SnapshotEntries(t *testing.T) {
+	cache := NewMemoryStore(time.Hour)
+	defer cache.Close()
+
+	if err := cache.Set("expired", "expired", 50*time.Millisecond); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if err := cache.Set("kept", "kept", 300*time.Millisecond); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// the expired entries are dropped with the keys in Cache
+	if _, ok := cache.entries.Load("expired"); ok {
+		t.Errorf("Expected the expired entry dropped")
+	}
+	// taking a snapshot does not extend the ttl
+	if err := cache.Snapshot(ioutil.Discard); err != nil {
+		t.Errorf("wrong to snapshot, but got: %s", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	var value string
+	if err := cache.Get("kept", &value); err != persist.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss, but got: %v", err)
+	}
+}
+
+func TestInMemoryCache_EntriesConcurrent(t *testing.T) {
+	cache := NewMemoryStore(time.Hour)
+	defer cache.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := strconv.Itoa(j % 16)
+				if (i+j)%2 == 0 {
+					_ = cache.Set(key, key, time.Hour)
+				} else {
+					_ = cache.Delete(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// the entries are kept for the keys in Cache only
+	keys := make(map[string]bool)
+	for _, key := range cache.Cache.GetKeys() {
+		keys[key] = true
+	}
+	cache.entries.Range(func(key, _ interface{}) bool {
+		if !keys[key.(string)] {
+			t.Errorf("Expected no entry of the deleted key %s", key)
+		}
+		delete(keys, key.(string))
+		return true
+	})
+	if len(keys) != 0 {
+		t.Errorf("Expected the entries of the keys %v", keys)
+	}
+}
+
+func TestInMemoryCache_SnapshotFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	// nothing to restore at the first start
+	cache := NewMemoryStore(time.Hour, WithSnapshotFile(path))
+	if err := cache.Set("value", "foo", time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatalf("wrong to close, but got: %s", err)
+	}
+
+	cache = NewMemoryStore(time.Hour, WithSnapshotFile(path))
+	defer cache.Close()
+	var value string
+	if err := cache.Get("value", &value); err != nil || value != "foo" {
+		t.Errorf("Expected to get foo back after restart, got %s, %v", value, err)
+	}
+}
+
+func TestShardedCache_TypicalGetSet(t *testing.T) {
+	var err error
+	cache := NewShardedStore(time.Hour, 0)
+	defer cache.Close()
+
+	value := "foo"
+	if err = cache.Set("value", value, time.Hour); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+
+	value = ""
+	err = cache.Get("value", &value)
+	if err != nil {
+		t.Errorf("Error getting a value: %s", err)
+	}
+	if value != "foo" {
+		t.Errorf("Expected to get foo back, got %s", value)
+	}
+
+	v := &snapshotValue{Name: "bar", Count: 1}
+	if err = cache.Set("struct", v, time.Hour); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+	var got snapshotValue
+	if err = cache.Get("struct", &got); err != nil || got != *v {
+		t.Errorf("Expected to get %+v back, got %+v, %v", *v, got, err)
+	}
+}
+
+func TestShardedCache_Expiration(t *testing.T) {
+	cache := NewShardedStore(50*time.Millisecond, 4)
+	defer cache.Close()
+	value := 10
+
+	// Test Set w/ default time
+	if err := cache.Set("int", value, 0); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	// Test Set w/ forever
+	if err := cache.Set("forever", value, -1); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	// Test Set w/ longer time, then shorter
+	if err := cache.Set("shorter", value, time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if err := cache.Set("shorter", value, time.Millisecond); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	// Test Set w/ short time, then forever
+	if err := cache.Set("longer", value, time.Millisecond); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	if err := cache.Set("longer", value, -1); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for _, key := range []string{"int", "shorter"} {
+		if err := cache.Get(key, &value); err != persist.ErrCacheMiss {
+			t.Errorf("Expected CacheMiss of %s, but got: %v", key, err)
+		}
+	}
+	for _, key := range []string{"forever", "longer"} {
+		if err := cache.Get(key, &value); err != nil {
+			t.Errorf("Expected to get %s, but got: %s", key, err)
+		}
+	}
+
+	cache.deleteExpired()
+	if cache.Len() != 2 {
+		t.Errorf("Expected 2 items after removing the expired, got %d", cache.Len())
+	}
+}
+
+func TestShardedCache_EmptyCache(t *testing.T) {
+	var err error
+	cache := NewShardedStore(time.Hour, 0)
+	defer cache.Close()
+
+	err = cache.Get("notexist", time.Hour)
+	if err != persist.ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss for non-existent key: %s", err)
+	}
+
+	// do nothing if the key doesn't exist, as the CacheStore contract says
+	err = cache.Delete("notexist")
+	if err != nil {
+		t.Errorf("Expected nil for non-existent key: %s", err)
+	}
+
+	if err = cache.Set("value", "foo", time.Hour); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+	if err = cache.Delete("value"); err != nil {
+		t.Errorf("Error deleting a value: %s", err)
+	}
+	if err = cache.Get("value", new(string)); err != persist.ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss for deleted key: %s", err)
+	}
+}
+
+// copierValue a value copied without reflection
+type copierValue struct {
+	data []byte
+}
+
+func (v *copierValue) CopyFrom(src interface{}) bool {
+	s, ok := src.(*copierValue)
+	if ok {
+		*v = *s
+	}
+	return ok
+}
+
+func benchmarkStoreGet(b *testing.B, store persist.CacheStore) {
+	const keys = 1024
+	for i := 0; i < keys; i++ {
+		_ = store.Set("key"+strconv.Itoa(i), &copierValue{data: []byte("value")}, time.Hour)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var value copierValue
+		i := 0
+		for pb.Next() {
+			_ = store.Get("key"+strconv.Itoa(i%keys), &value)
+			i++
+		}
+	})
+}
+
+func benchmarkStoreMixed(b *testing.B, store persist.CacheStore) {
+	const keys = 1024
+	value := &copierValue{data: []byte("value")}
+	for i := 0; i < keys; i++ {
+		_ = store.Set("key"+strconv.Itoa(i), value, time.Hour)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var got copierValue
+		i := 0
+		for pb.Next() {
+			key := "key" + strconv.Itoa(i%keys)
+			// one write every ten reads
+			if i%10 == 0 {
+				_ = store.Set(key, value, time.Hour)
+			} else {
+				_ = store.Get(key, &got)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkStoreGetParallel(b *testing.B) {
+	b.Run("memory", func(b *testing.B) {
+		store := NewMemoryStore(time.Hour)
+		defer store.Close()
+		benchmarkStoreGet(b, store)
+	})
+	b.Run("sharded", func(b *testing.B) {
+		store := NewShardedStore(time.Hour, 0)
+		defer store.Close()
+		benchmarkStoreGet(b, store)
+	})
+}
+
+func BenchmarkStoreMixedParallel(b *testing.B) {
+	b.Run("memory", func(b *testing.B) {
+		store := NewMemoryStore(time.Hour)
+		defer store.Close()
+		benchmarkStoreMixed(b, store)
+	})
+	b.Run("sharded", func(b *testing.B) {
+		store := NewShardedStore(time.Hour, 0)
+		defer store.Close()
+		benchmarkStoreMixed(b, store)
+	})
+}
+
+func testCapabilities(t *testing.T, store persist.CacheStore) {
+	for _, key := range []string{"prefix:1", "prefix:2", "other:1"} {
+		if err := store.Set(key, key, time.Hour); err != nil {
+			t.Errorf("wrong to set cache, but got: %s", err)
+		}
+	}
+
+	exister := store.(persist.Exister)
+	if ok, err := exister.Exists("prefix:1"); err != nil || !ok {
+		t.Errorf("Expected prefix:1 exists, got %v, %v", ok, err)
+	}
+	if ok, err := exister.Exists("notexist"); err != nil || ok {
+		t.Errorf("Expected notexist not exists, got %v, %v", ok, err)
+	}
+
+	ttler := store.(persist.TTLer)
+	if ttl, err := ttler.TTL("prefix:1"); err != nil || ttl <= time.Hour-time.Minute || ttl > time.Hour {
+		t.Errorf("Expected the ttl about an hour, got %s, %v", ttl, err)
+	}
+	if _, err := ttler.TTL("notexist"); err != persist.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss, but got: %v", err)
+	}
+
+	toucher := store.(persist.Toucher)
+	if err := toucher.Touch("prefix:1", 2*time.Hour); err != nil {
+		t.Errorf("wrong to touch, but got: %s", err)
+	}
+	if ttl, err := ttler.TTL("prefix:1"); err != nil || ttl <= time.Hour {
+		t.Errorf("Expected the ttl about two hours, got %s, %v", ttl, err)
+	}
+	if err := toucher.Touch("prefix:2", 0); err != nil {
+		t.Errorf("wrong to touch, but got: %s", err)
+	}
+	if ttl, err := ttler.TTL("prefix:2"); err != nil || ttl != persist.NoExpiration {
+		t.Errorf("Expected no expiration, got %s, %v", ttl, err)
+	}
+	if err := toucher.Touch("notexist", time.Hour); err != persist.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss, but got: %v", err)
+	}
+	var value string
+	if err := store.Get("prefix:2", &value); err != nil || value != "prefix:2" {
+		t.Errorf("Expected to get prefix:2 back after touch, got %s, %v", value, err)
+	}
+
+	keys, err := store.(persist.KeyScanner).Keys("prefix:")
+	sort.Strings(keys)
+	if err != nil || !reflect.DeepEqual(keys, []string{"prefix:1", "prefix:2"}) {
+		t.Errorf("Expected the keys with prefix, got %v, %v", keys, err)
+	}
+
+	if err := store.(persist.Clearer).Clear(); err != nil {
+		t.Errorf("wrong to clear, but got: %s", err)
+	}
+	if keys, err := store.(persist.KeyScanner).Keys(""); err != nil || len(keys) != 0 {
+		t.Errorf("Expected no keys after clear, got %v, %v", keys, err)
+	}
+	if err := store.Get("other:1", &value); err != persist.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss, but got: %v", err)
+	}
+}
+
+func TestInMemoryCache_Capabilities(t *testing.T) {
+	store := NewMemoryStore(time.Hour)
+	defer store.Close()
+	testCapabilities(t, store)
+}
+
+func TestInMemoryCache_ExistsNotExtend(t *testing.T) {
+	store := NewMemoryStore(time.Hour)
+	defer store.Close()
+
+	if err := store.Set("key", "value", 300*time.Millisecond); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if ok, err := store.Exists("key"); err != nil || !ok {
+		t.Errorf("Expected key exists, got %v, %v", ok, err)
+	}
+	if ttl, err := store.TTL("key"); err != nil || ttl <= 0 || ttl > 100*time.Millisecond {
+		t.Errorf("Expected the ttl under 100ms, got %s, %v", ttl, err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	var value string
+	if err := store.Get("key", &value); err != persist.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss as Exists and TTL do not extend the ttl, but got: %v", err)
+	}
+	if ok, _ := store.Exists("key"); ok {
+		t.Errorf("Expected the expired key not exists")
+	}
+
+	// a hit extends the ttl in Cache, which TTL reports
+	if err := store.Set("hit", "value", 300*time.Millisecond); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := store.Get("hit", &value); err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+	if ttl, err := store.TTL("hit"); err != nil || ttl <= 200*time.Millisecond {
+		t.Errorf("Expected the ttl extended by the hit, got %s, %v", ttl, err)
+	}
+}
+
+func TestShardedCache_Capabilities(t *testing.T) {
+	store := NewShardedStore(time.Hour, 0)
+	defer store.Close()
+	testCapabilities(t, store)
+
+	if err := store.Set("expired", "expired", time.Millisecond); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if ok, _ := store.Exists("expired"); ok {
+		t.Errorf("Expected the expired key not exists")
+	}
+	if keys, _ := store.Keys(""); len(keys) != 0 {
+		t.Errorf("Expected no keys, got %v", keys)
+	}
+	if err := store.Touch("expired", time.Hour); err != persist.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss, but got: %v", err)
+	}
+}
+
+func testMulti(t *testing.T, store persist.CacheStore) {
+	keys := []string{"k1", "k2", "k3"}
+	if err := persist.SetMulti(store, keys[:2], []interface{}{"v1", "v2"}, time.Hour); err != nil {
+		t.Errorf("wrong to set multi, but got: %s", err)
+	}
+	if err := persist.SetMulti(store, keys, []interface{}{"v1"}, time.Hour); err != persist.ErrMultiLength {
+		t.Errorf("Expected ErrMultiLength, but got: %v", err)
+	}
+
+	values := make([]string, len(keys))
+	errs := persist.GetMulti(store, keys, []interface{}{&values[0], &values[1], &values[2]})
+	if errs[0] != nil || errs[1] != nil || errs[2] != persist.ErrCacheMiss {
+		t.Errorf("Expected k1 and k2 found and k3 missed, got %v", errs)
+	}
+	if values[0] != "v1" || values[1] != "v2" {
+		t.Errorf("Expected to get v1 and v2 back, got %v", values)
+	}
+
+	if err := persist.DeleteMulti(store, keys...); err != nil {
+		t.Errorf("wrong to delete multi, but got: %s", err)
+	}
+	for i, err := range persist.GetMulti(store, keys, []interface{}{&values[0], &values[1], &values[2]}) {
+		if err != persist.ErrCacheMiss {
+			t.Errorf("Expected CacheMiss of %s, but got: %v", keys[i], err)
+		}
+	}
+}
+
+func TestInMemoryCache_Multi(t *testing.T) {
+	store := NewMemoryStore(time.Hour)
+	defer store.Close()
+	testMulti(t, store)
+}
+
+func TestShardedCache_Multi(t *testing.T) {
+	store := NewShardedStore(time.Hour, 0)
+	defer store.Close()
+	testMulti(t, store)
+}
+
+func TestMultiFallback(t *testing.T) {
+	store := NewMemoryStore(time.Hour)
+	defer store.Close()
+	// hide the batch methods, so that the keys are handled one by one
+	testMulti(t, struct{ persist.CacheStore }{store})
+}
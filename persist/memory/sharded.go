@@ -0,0 +1,392 @@
+package memory
+
+import (
+	"container/heap"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wyy-go/wcache/persist"
+)
+
+// DefaultShards the default number of shards of ShardedStore
+const DefaultShards = 64
+
+// cleanupInterval the interval of removing the expired items in background
+const cleanupInterval = time.Second
+
+// ShardedStore local memory cache store split into lock-striped shards, so that concurrent
+// hits on different keys do not contend on a single mutex. each shard keeps an expiry heap,
+// the expired items are skipped on read and removed in background.
+type ShardedStore struct {
+	shards            []*shard
+	mask              uint32
+	defaultExpiration time.Duration
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+var _ persist.CacheStore = (*ShardedStore)(nil)
+var _ persist.Loader = (*ShardedStore)(nil)
+var _ persist.Exister = (*ShardedStore)(nil)
+var _ persist.TTLer = (*ShardedStore)(nil)
+var _ persist.Toucher = (*ShardedStore)(nil)
+var _ persist.Clearer = (*ShardedStore)(nil)
+var _ persist.KeyScanner = (*ShardedStore)(nil)
+var _ persist.MultiGetter = (*ShardedStore)(nil)
+var _ persist.MultiSetter = (*ShardedStore)(nil)
+var _ persist.MultiDeleter = (*ShardedStore)(nil)
+
+type shard struct {
+	mu    sync.RWMutex
+	items map[string]*shardItem
+	// expiry the items with an expire time, the soonest first
+	expiry expiryHeap
+}
+
+type shardItem struct {
+	key   string
+	value interface{}
+	// expireAt the unix nano of expire time, 0 means never expire
+	expireAt int64
+	// index the index in expiry heap, -1 if not in it
+	index int
+}
+
+// NewShardedStore allocate a sharded memory store with default expiration, the number of
+// shards is rounded up to a power of two, DefaultShards if not positive
+func NewShardedStore(defaultExpiration time.Duration, shards int) *ShardedStore {
+	if shards <= 0 {
+		shards = DefaultShards
+	}
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+
+	store := &ShardedStore{
+		shards:            make([]*shard, n),
+		mask:              uint32(n - 1),
+		defaultExpiration: defaultExpiration,
+		stop:              make(chan struct{}),
+	}
+	for i := range store.shards {
+		store.shards[i] = &shard{items: make(map[string]*shardItem)}
+	}
+
+	store.wg.Add(1)
+	go store.cleanupLoop()
+	return store
+}
+
+// Set put key value pair to memory store, and expire after expireDuration,
+// 0 means the default expiration, a negative one means never expire
+func (c *ShardedStore) Set(key string, value interface{}, expireDuration time.Duration) error {
+	if expireDuration == 0 {
+		expireDuration = c.defaultExpiration
+	}
+	var expireAt int64
+	if expireDuration > 0 {
+		expireAt = time.Now().Add(expireDuration).UnixNano()
+	}
+
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[key]
+	if !ok {
+		item = &shardItem{key: key, index: -1}
+		s.items[key] = item
+	}
+	item.value = value
+	s.setExpireAt(item, expireAt)
+	return nil
+}
+
+// Delete remove key in memory store, do nothing if key doesn't exist
+func (c *ShardedStore) Delete(key string) error {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item, ok := s.items[key]; ok {
+		s.remove(item)
+	}
+	return nil
+}
+
+// Get get key in memory store, if key doesn't exist or has expired, return ErrCacheMiss
+func (c *ShardedStore) Get(key string, value interface{}) error {
+	s := c.shard(key)
+	s.mu.RLock()
+	item, ok := s.items[key]
+	if !ok || item.expired(time.Now().UnixNano()) {
+		s.mu.RUnlock()
+		return persist.ErrCacheMiss
+	}
+	val := item.value
+	s.mu.RUnlock()
+
+	copyValue(value, val)
+	return nil
+}
+
+// GetMulti get keys in memory store, the errors are ErrCacheMiss for the keys don't exist or have expired
+func (c *ShardedStore) GetMulti(keys []string, values []interface{}) []error {
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		errs[i] = c.Get(key, values[i])
+	}
+	return errs
+}
+
+// SetMulti put key value pairs to memory store, and expire after expireDuration,
+// 0 means the default expiration, a negative one means never expire
+func (c *ShardedStore) SetMulti(keys []string, values []interface{}, expireDuration time.Duration) error {
+	if len(keys) != len(values) {
+		return persist.ErrMultiLength
+	}
+	if expireDuration == 0 {
+		expireDuration = c.defaultExpiration
+	}
+	var expireAt int64
+	if expireDuration > 0 {
+		expireAt = time.Now().Add(expireDuration).UnixNano()
+	}
+
+	for i, key := range keys {
+		s := c.shard(key)
+		s.mu.Lock()
+		item, ok := s.items[key]
+		if !ok {
+			item = &shardItem{key: key, index: -1}
+			s.items[key] = item
+		}
+		item.value = values[i]
+		s.setExpireAt(item, expireAt)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// DeleteMulti remove keys in memory store, the missing ones are skipped
+func (c *ShardedStore) DeleteMulti(keys ...string) error {
+	for _, key := range keys {
+		s := c.shard(key)
+		s.mu.Lock()
+		if item, ok := s.items[key]; ok {
+			s.remove(item)
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Load get key in memory store as it was set without copying, if key doesn't exist or has expired,
+// return ErrCacheMiss
+func (c *ShardedStore) Load(key string) (interface{}, error) {
+	s := c.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	item, ok := s.items[key]
+	if !ok || item.expired(time.Now().UnixNano()) {
+		return nil, persist.ErrCacheMiss
+	}
+	return item.value, nil
+}
+
+// Exists report whether key exists in memory store and has not expired
+func (c *ShardedStore) Exists(key string) (bool, error) {
+	s := c.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	item, ok := s.items[key]
+	return ok && !item.expired(time.Now().UnixNano()), nil
+}
+
+// TTL return the remaining ttl of key, NoExpiration if it never expires
+func (c *ShardedStore) TTL(key string) (time.Duration, error) {
+	s := c.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	item, ok := s.items[key]
+	if !ok || item.expired(now) {
+		return 0, persist.ErrCacheMiss
+	}
+	if item.expireAt == 0 {
+		return persist.NoExpiration, nil
+	}
+	return time.Duration(item.expireAt - now), nil
+}
+
+// Touch set key to expire after expireDuration, a non-positive one means never expire
+func (c *ShardedStore) Touch(key string, expireDuration time.Duration) error {
+	var expireAt int64
+	if expireDuration > 0 {
+		expireAt = time.Now().Add(expireDuration).UnixNano()
+	}
+
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[key]
+	if !ok || item.expired(time.Now().UnixNano()) {
+		return persist.ErrCacheMiss
+	}
+	s.setExpireAt(item, expireAt)
+	return nil
+}
+
+// Clear remove all keys in memory store, one shard locked at a time
+func (c *ShardedStore) Clear() error {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.items = make(map[string]*shardItem)
+		s.expiry = nil
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Keys return all keys start with prefix and not expired in memory store
+func (c *ShardedStore) Keys(prefix string) ([]string, error) {
+	var keys []string
+	now := time.Now().UnixNano()
+	for _, s := range c.shards {
+		s.mu.RLock()
+		for key, item := range s.items {
+			if strings.HasPrefix(key, prefix) && !item.expired(now) {
+				keys = append(keys, key)
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return keys, nil
+}
+
+// Len return the number of items, including the expired ones not removed yet
+func (c *ShardedStore) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.RLock()
+		n += len(s.items)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// Close stop removing the expired items in background
+func (c *ShardedStore) Close() error {
+	c.once.Do(func() {
+		close(c.stop)
+	})
+	c.wg.Wait()
+	return nil
+}
+
+func (c *ShardedStore) cleanupLoop() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.deleteExpired()
+		}
+	}
+}
+
+// deleteExpired remove the expired items of every shard, one shard locked at a time
+func (c *ShardedStore) deleteExpired() {
+	for _, s := range c.shards {
+		now := time.Now().UnixNano()
+		s.mu.Lock()
+		for len(s.expiry) > 0 && s.expiry[0].expired(now) {
+			s.remove(s.expiry[0])
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (c *ShardedStore) shard(key string) *shard {
+	return c.shards[fnv32a(key)&c.mask]
+}
+
+// remove delete the item from the map and the heap, the caller must hold the lock
+func (s *shard) remove(item *shardItem) {
+	delete(s.items, item.key)
+	if item.index >= 0 {
+		heap.Remove(&s.expiry, item.index)
+	}
+}
+
+// setExpireAt change the expire time of the item and its place in the heap, the caller must hold the lock
+func (s *shard) setExpireAt(item *shardItem, expireAt int64) {
+	item.expireAt = expireAt
+	switch {
+	case expireAt == 0 && item.index >= 0:
+		heap.Remove(&s.expiry, item.index)
+	case expireAt != 0 && item.index >= 0:
+		heap.Fix(&s.expiry, item.index)
+	case expireAt != 0:
+		heap.Push(&s.expiry, item)
+	}
+}
+
+func (item *shardItem) expired(now int64) bool {
+	return item.expireAt != 0 && item.expireAt <= now
+}
+
+// expiryHeap a min heap of items by expire time, implements heap.Interface
+type expiryHeap []*shardItem
+
+func (h expiryHeap) Len() int { return len(h) }
+
+func (h expiryHeap) Less(i, j int) bool { return h[i].expireAt < h[j].expireAt }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*shardItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*h = old[:n-1]
+	return item
+}
+
+// fnv32a the 32-bit FNV-1a hash of key, without allocation
+func fnv32a(key string) uint32 {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	hash := uint32(offset32)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= prime32
+	}
+	return hash
+}
@@ -0,0 +1,273 @@
+package memory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/ReneKroon/ttlcache/v2"
+	"github.com/wyy-go/wcache/persist"
+)
+
+const (
+	snapshotMagic   = "wcms"
+	snapshotVersion = 2
+
+	// maxSnapshotLength the max length of a key or value in snapshot, guard against a malformed one
+	maxSnapshotLength = 1 << 30
+)
+
+// ErrSnapshotFormat represent the snapshot is malformed
+var ErrSnapshotFormat = errors.New("memory snapshot format error")
+
+// Encoding encode the values in snapshot, the Encoding of wcache satisfies it
+type Encoding interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// rawValue a value restored from snapshot, which is decoded on read
+type rawValue []byte
+
+// Snapshot write the entries not expired with their expire time, and the tags of them to w.
+// the values are not read from Cache, so taking a snapshot does not extend their ttl.
+func (c *MemoryStore) Snapshot(w io.Writer) error {
+	type item struct {
+		key   string
+		value interface{}
+		// expireAt the expire time in unix nanoseconds, 0 means never expire
+		expireAt int64
+	}
+
+	now := time.Now()
+	keys := c.Cache.GetKeys()
+	items := make([]item, 0, len(keys))
+	written := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		v, ok := c.entries.Load(key)
+		if !ok {
+			continue
+		}
+		e := v.(*entry)
+		var expireAt int64
+		if e.ttl > 0 {
+			if expireAt = atomic.LoadInt64(&e.expireAt); expireAt <= now.UnixNano() {
+				continue
+			}
+		}
+		items = append(items, item{key: key, value: e.value, expireAt: expireAt})
+		written[key] = struct{}{}
+	}
+
+	c.tagsMu.Lock()
+	tags := make(map[string][]string, len(c.tags))
+	for tag, keys := range c.tags {
+		for key := range keys {
+			if _, ok := written[key]; ok {
+				tags[tag] = append(tags[tag], key)
+			}
+		}
+	}
+	c.tagsMu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	buf := append([]byte(snapshotMagic), snapshotVersion)
+	buf = appendUvarint(buf, uint64(len(items)))
+	for _, it := range items {
+		data, err := c.marshal(it.value)
+		if err != nil {
+			return err
+		}
+		buf = appendBytes(buf, []byte(it.key))
+		buf = appendUvarint(buf, uint64(it.expireAt))
+		buf = appendBytes(buf, data)
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+		buf = buf[:0]
+	}
+
+	buf = appendUvarint(buf, uint64(len(tags)))
+	for tag, keys := range tags {
+		buf = appendBytes(buf, []byte(tag))
+		buf = appendUvarint(buf, uint64(len(keys)))
+		for _, key := range keys {
+			buf = appendBytes(buf, []byte(key))
+		}
+	}
+	if _, err := bw.Write(buf); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Restore read the snapshot written by Snapshot from r, and set the entries until their expire time,
+// the ones expired since are skipped. the values are decoded on read by the Encoding, as the type of
+// them is unknown until then.
+func (c *MemoryStore) Restore(r io.Reader) error {
+	type item struct {
+		key      string
+		data     []byte
+		expireAt int64
+	}
+
+	br := bufio.NewReader(r)
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return ErrSnapshotFormat
+	}
+	if header[len(snapshotMagic)] != snapshotVersion {
+		return ErrSnapshotFormat
+	}
+
+	n, err := readUvarint(br)
+	if err != nil {
+		return err
+	}
+	var items []item
+	for i := uint64(0); i < n; i++ {
+		key, err := readBytes(br)
+		if err != nil {
+			return err
+		}
+		expireAt, err := readUvarint(br)
+		if err != nil {
+			return err
+		}
+		data, err := readBytes(br)
+		if err != nil {
+			return err
+		}
+		items = append(items, item{key: string(key), data: data, expireAt: int64(expireAt)})
+	}
+
+	n, err = readUvarint(br)
+	if err != nil {
+		return err
+	}
+	tags := make(map[string][]string)
+	for i := uint64(0); i < n; i++ {
+		tag, err := readBytes(br)
+		if err != nil {
+			return err
+		}
+		count, err := readUvarint(br)
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < count; j++ {
+			key, err := readBytes(br)
+			if err != nil {
+				return err
+			}
+			tags[string(tag)] = append(tags[string(tag)], string(key))
+		}
+	}
+
+	restored := make(map[string]struct{}, len(items))
+	for _, it := range items {
+		ttl := ttlcache.ItemNotExpire
+		if it.expireAt != 0 {
+			if ttl = time.Until(time.Unix(0, it.expireAt)); ttl <= 0 {
+				continue
+			}
+		}
+		if err := c.set(it.key, rawValue(it.data), ttl); err != nil {
+			return err
+		}
+		restored[it.key] = struct{}{}
+	}
+	c.tagsMu.Lock()
+	defer c.tagsMu.Unlock()
+	for tag, keys := range tags {
+		for _, key := range keys {
+			if _, ok := restored[key]; ok {
+				c.addTags(key, []string{tag})
+			}
+		}
+	}
+	return nil
+}
+
+// SaveSnapshotFile write the snapshot to a temporary file, then rename it to path
+func (c *MemoryStore) SaveSnapshotFile(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	err = c.Snapshot(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// LoadSnapshotFile restore the store from the snapshot file at path
+func (c *MemoryStore) LoadSnapshotFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.Restore(f)
+}
+
+func (c *MemoryStore) marshal(value interface{}) ([]byte, error) {
+	if raw, ok := value.(rawValue); ok {
+		return raw, nil
+	}
+	if c.options.encoding != nil {
+		return c.options.encoding.Marshal(value)
+	}
+	return persist.Marshal(value)
+}
+
+func (c *MemoryStore) unmarshal(data []byte, value interface{}) error {
+	if c.options.encoding != nil {
+		return c.options.encoding.Unmarshal(data, value)
+	}
+	return persist.Unmarshal(data, value)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func appendBytes(buf []byte, data []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func readUvarint(r *bufio.Reader) (uint64, error) {
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, ErrSnapshotFormat
+	}
+	return v, nil
+}
+
+func readBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := readUvarint(r)
+	if err != nil || n > maxSnapshotLength {
+		return nil, ErrSnapshotFormat
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, ErrSnapshotFormat
+	}
+	return data, nil
+}
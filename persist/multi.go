@@ -0,0 +1,83 @@
+package persist
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrMultiLength represent the keys and values of a batch differ in length
+var ErrMultiLength = errors.New("persist keys and values length mismatch")
+
+// MultiGetter is implemented by the stores which can retrieve many keys in a batch
+type MultiGetter interface {
+	// GetMulti retrieves the items of keys into the values at the same index, which must be pointers.
+	// the returned errors are per key at the same index, ErrCacheMiss if the key does not exist.
+	GetMulti(keys []string, values []interface{}) []error
+}
+
+// MultiSetter is implemented by the stores which can set many keys in a batch
+type MultiSetter interface {
+	// SetMulti sets the values to the keys at the same index, all expire after expire.
+	SetMulti(keys []string, values []interface{}, expire time.Duration) error
+}
+
+// MultiDeleter is implemented by the stores which can remove many keys in a batch
+type MultiDeleter interface {
+	// DeleteMulti removes the keys, the missing ones are skipped.
+	DeleteMulti(keys ...string) error
+}
+
+// GetMulti retrieves the items of keys by the MultiGetter of store, or one by one if not implemented
+func GetMulti(store CacheStore, keys []string, values []interface{}) []error {
+	if len(keys) != len(values) {
+		errs := make([]error, len(keys))
+		for i := range errs {
+			errs[i] = ErrMultiLength
+		}
+		return errs
+	}
+	if getter, ok := store.(MultiGetter); ok {
+		return getter.GetMulti(keys, values)
+	}
+
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		errs[i] = store.Get(key, values[i])
+	}
+	return errs
+}
+
+// SetMulti sets the values to the keys by the MultiSetter of store, or one by one if not implemented,
+// the first error is returned after trying all keys
+func SetMulti(store CacheStore, keys []string, values []interface{}, expire time.Duration) error {
+	if len(keys) != len(values) {
+		return ErrMultiLength
+	}
+	if setter, ok := store.(MultiSetter); ok {
+		return setter.SetMulti(keys, values, expire)
+	}
+
+	var first error
+	for i, key := range keys {
+		if err := store.Set(key, values[i], expire); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// DeleteMulti removes the keys by the MultiDeleter of store, or one by one if not implemented,
+// the missing keys are skipped and the first error is returned after trying all keys
+func DeleteMulti(store CacheStore, keys ...string) error {
+	if deleter, ok := store.(MultiDeleter); ok {
+		return deleter.DeleteMulti(keys...)
+	}
+
+	var first error
+	for _, key := range keys {
+		if err := store.Delete(key); err != nil && !errors.Is(err, ErrCacheMiss) && first == nil {
+			first = err
+		}
+	}
+	return first
+}
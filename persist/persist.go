@@ -2,6 +2,7 @@ package persist
 
 import (
 	"errors"
+	"io"
 	"time"
 )
 
@@ -19,3 +20,115 @@ type CacheStore interface {
 	// Delete removes an item from the Cache. Does nothing if the key is not in the Cache.
 	Delete(key string) error
 }
+
+// TagStore is implemented by the stores which can index keys by tags
+type TagStore interface {
+	// AddTags attach the key to tags, the tag index lives at least as long as the key.
+	AddTags(key string, tags []string, expire time.Duration) error
+
+	// InvalidateTags removes all keys attached to the tags, and the tags themselves.
+	InvalidateTags(tags ...string) error
+}
+
+// PrefixDeleter is implemented by the stores which can remove keys by prefix
+type PrefixDeleter interface {
+	// DeletePrefix removes all keys start with prefix.
+	DeletePrefix(prefix string) error
+}
+
+// BodySplitter is implemented by the values whose body can be stored apart from the rest
+type BodySplitter interface {
+	// SplitBody returns the value encoded without the body, and the body.
+	SplitBody() (head []byte, body []byte, err error)
+
+	// JoinBody decodes the head returned by SplitBody, and sets the body.
+	JoinBody(head []byte, body []byte) error
+}
+
+// BodyOpener is implemented by the stores which keep the body of a BodySplitter apart, e.g. as a file,
+// so that it can be served without loading into memory
+type BodyOpener interface {
+	// OpenBody retrieves the value without its body, and opens the body. the body is nil if the value
+	// was not stored apart, then it is retrieved as a whole. if key does not exist, return ErrCacheMiss
+	OpenBody(key string, value interface{}) (io.ReadSeekCloser, error)
+}
+
+// Copier is implemented by the values which can be copied from a value of the same type,
+// so that the memory stores can retrieve them without reflection
+type Copier interface {
+	// CopyFrom sets the receiver to src, reports false if src is not of the same type.
+	CopyFrom(src interface{}) bool
+}
+
+// Loader is implemented by the in-process stores which keep the values as they are set,
+// so that a value can be shared by the readers without decoding or copying
+type Loader interface {
+	// Load returns the value as it was set, which must be treated as immutable by the caller.
+	// if key does not exist, return ErrCacheMiss
+	Load(key string) (interface{}, error)
+}
+
+// NoExpiration is the ttl reported by TTLer for the keys which never expire
+const NoExpiration time.Duration = -1
+
+// Exister is implemented by the stores which can tell whether a key exists without retrieving it
+type Exister interface {
+	// Exists reports whether the key exists and has not expired.
+	Exists(key string) (bool, error)
+}
+
+// TTLer is implemented by the stores which can tell the remaining time to live of a key
+type TTLer interface {
+	// TTL returns the remaining time to live of the key, NoExpiration if it never expires.
+	// if key does not exist, return ErrCacheMiss
+	TTL(key string) (time.Duration, error)
+}
+
+// Toucher is implemented by the stores which can change the expiration of a key without rewriting it
+type Toucher interface {
+	// Touch sets the key to expire after expire, a non-positive expire means never expire.
+	// if key does not exist, return ErrCacheMiss
+	Touch(key string, expire time.Duration) error
+}
+
+// Clearer is implemented by the stores which can remove all keys
+type Clearer interface {
+	// Clear removes all keys in the store.
+	Clear() error
+}
+
+// KeyScanner is implemented by the stores which can list keys
+type KeyScanner interface {
+	// Keys returns all keys start with prefix, in no particular order.
+	Keys(prefix string) ([]string, error)
+}
+
+// ErrLocked represent the lock is held by another
+var ErrLocked = errors.New("persist lock is held by another")
+
+// ErrLockLost represent the lease has expired and the lock has been acquired by another since
+var ErrLockLost = errors.New("persist lock is lost to another")
+
+// Lease a lock acquired from a Locker, held until it is released or expires
+type Lease interface {
+	// Fence returns the fencing token, which increases on every acquisition of the key,
+	// so that the writes of a holder whose lease has expired can be told apart.
+	Fence() int64
+	// Release releases the lock if it is still held by the lease, or does nothing.
+	Release() error
+}
+
+// Locker is implemented by the stores which can hold locks shared by processes
+type Locker interface {
+	// TryLock acquires the lock of key for ttl without waiting.
+	// if the lock is held by another, return ErrLocked
+	TryLock(key string, ttl time.Duration) (Lease, error)
+}
+
+// FencedSetter is implemented by the Locker stores which can guard a write by the fence of a lease
+type FencedSetter interface {
+	// SetFenced sets the value to key as Set, only if fence is still the latest one of the lock of key,
+	// so that a holder whose lease has expired can not overwrite the value of the next holder.
+	// otherwise return ErrLockLost
+	SetFenced(key string, value interface{}, expire time.Duration, fence int64) error
+}
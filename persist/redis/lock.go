@@ -0,0 +1,144 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/wyy-go/wcache/persist"
+)
+
+// LockKeyPrefix the key prefix of the locks and their fencing counters
+var LockKeyPrefix = "wcache.lock:"
+
+// fenceExpire the fencing counter of a key outlives its locks by far, so that the tokens keep increasing
+const fenceExpire = 24 * time.Hour
+
+// lockScript set the lock if it is not held, and increase the fencing counter of it
+var lockScript = redis.NewScript(`
+if not redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 0
+end
+local fence = redis.call('INCR', KEYS[2])
+redis.call('PEXPIRE', KEYS[2], ARGV[3])
+return fence
+`)
+
+// setFencedScript set the key only if the fencing counter still equals to the fence of the lease
+var setFencedScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[2], ARGV[2], 'PX', ARGV[3])
+else
+	redis.call('SET', KEYS[2], ARGV[2])
+end
+return 1
+`)
+
+// unlockScript delete the lock only if it is still held by the token
+var unlockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+var _ persist.Locker = (*RedisStore)(nil)
+var _ persist.FencedSetter = (*RedisStore)(nil)
+
+// TryLock acquire the lock of key for ttl by SET NX PX, with a fencing token increased on every acquisition.
+// the lock and its counter share the hash tag of key, so that they live in the same slot of cluster,
+// or the same shard of ring, as key itself.
+func (store *RedisStore) TryLock(key string, ttl time.Duration) (persist.Lease, error) {
+	ctx := context.TODO()
+	token, err := lockToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl < time.Millisecond {
+		// PX takes whole milliseconds only
+		ttl = time.Millisecond
+	}
+
+	lockKey, fenceKey, _ := lockKeys(key)
+	keys := []string{lockKey, fenceKey}
+	fence, err := lockScript.Run(ctx, store.RedisClient, keys, token, ttl.Milliseconds(), fenceExpire.Milliseconds()).Int64()
+	if err != nil {
+		return nil, err
+	}
+	if fence == 0 {
+		return nil, persist.ErrLocked
+	}
+	return &lease{client: store.RedisClient, key: lockKey, token: token, fence: fence}, nil
+}
+
+// SetFenced put key value pair to redis as Set, only if fence is still the latest one of the lock of key,
+// otherwise return ErrLockLost. it is checked and set atomically by a script, except for the rare keys
+// of cluster and ring whose lock can not share their slot, which are checked right before set.
+func (store *RedisStore) SetFenced(key string, value interface{}, expire time.Duration, fence int64) error {
+	ctx := context.TODO()
+	px := expire.Milliseconds()
+	if expire > 0 && px == 0 {
+		px = 1
+	}
+
+	_, fenceKey, colocated := lockKeys(key)
+	if _, single := store.RedisClient.(*redis.Client); single || colocated {
+		ok, err := setFencedScript.Run(ctx, store.RedisClient, []string{fenceKey, key}, fence, value, px).Int()
+		if err != nil {
+			return err
+		}
+		if ok == 0 {
+			return persist.ErrLockLost
+		}
+		return nil
+	}
+
+	current, err := store.RedisClient.Get(ctx, fenceKey).Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if current != fence {
+		return persist.ErrLockLost
+	}
+	return store.Set(key, value, expire)
+}
+
+// lockKeys return the keys of the lock and the fencing counter of key, which are hashed by the hash
+// tag of key if any, or the whole key, colocated reports whether they land on the same slot as key
+func lockKeys(key string) (lockKey, fenceKey string, colocated bool) {
+	part := hashedPart(key)
+	if part == key {
+		lockKey = LockKeyPrefix + HashTag(key)
+	} else {
+		lockKey = LockKeyPrefix + HashTag(part) + key
+	}
+	return lockKey, lockKey + ":fence", hashedPart(lockKey) == part
+}
+
+// lease a lock held by the random token
+type lease struct {
+	client redis.UniversalClient
+	key    string
+	token  string
+	fence  int64
+}
+
+func (l *lease) Fence() int64 { return l.fence }
+
+func (l *lease) Release() error {
+	return unlockScript.Run(context.TODO(), l.client, []string{l.key}, l.token).Err()
+}
+
+func lockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -3,20 +3,64 @@ package redis
 import (
 	"context"
 	"github.com/wyy-go/wcache/persist"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
+// DefaultKeyPrefix the default KeyPrefix of RedisStore, which the default page cache keys start with
+const DefaultKeyPrefix = "wcache."
+
+// TagKeyPrefix the key prefix of the tag index sets
+var TagKeyPrefix = "wcache.tag:"
+
+// scanCount the COUNT hint of SCAN when deleting by prefix
+const scanCount = 512
+
+// addTagScript add the key to the tag set, and keep the tag set alive at least as long as the key.
+// it is sent by EVAL, as EVALSHA in a pipeline can not fall back when the script is not loaded
+var addTagScript = redis.NewScript(`
+local added = redis.call('SADD', KEYS[1], ARGV[1])
+local want = tonumber(ARGV[2])
+if want <= 0 then
+	redis.call('PERSIST', KEYS[1])
+	return added
+end
+local ttl = redis.call('PTTL', KEYS[1])
+if (ttl >= 0 and ttl < want) or (ttl == -1 and redis.call('SCARD', KEYS[1]) == 1) then
+	redis.call('PEXPIRE', KEYS[1], want)
+end
+return added
+`)
+
 // RedisStore store http response in redis
 type RedisStore struct {
-	RedisClient *redis.Client
+	// RedisClient a *redis.Client, a failover client from redis.NewFailoverClient,
+	// a *redis.ClusterClient or a *redis.Ring
+	RedisClient redis.UniversalClient
+	// KeyPrefix the prefix of the cache keys, only the keys start with it, the tag sets
+	// and the locks are removed by Clear, DefaultKeyPrefix if empty
+	KeyPrefix string
 }
 
-// NewRedisStore create a redis memory store with redis client
-func NewRedisStore(redisClient *redis.Client) *RedisStore {
+var _ persist.TagStore = (*RedisStore)(nil)
+var _ persist.PrefixDeleter = (*RedisStore)(nil)
+var _ persist.Exister = (*RedisStore)(nil)
+var _ persist.TTLer = (*RedisStore)(nil)
+var _ persist.Toucher = (*RedisStore)(nil)
+var _ persist.Clearer = (*RedisStore)(nil)
+var _ persist.KeyScanner = (*RedisStore)(nil)
+var _ persist.MultiGetter = (*RedisStore)(nil)
+var _ persist.MultiSetter = (*RedisStore)(nil)
+var _ persist.MultiDeleter = (*RedisStore)(nil)
+
+// NewRedisStore create a redis memory store with redis client,
+// it can be a single node, sentinel failover, cluster or ring client
+func NewRedisStore(redisClient redis.UniversalClient) *RedisStore {
 	return &RedisStore{
 		RedisClient: redisClient,
+		KeyPrefix:   DefaultKeyPrefix,
 	}
 }
 
@@ -44,3 +88,293 @@ func (store *RedisStore) Get(key string, value interface{}) error {
 	}
 	return nil
 }
+
+// AddTags attach key to tags, the tag sets expire no earlier than key
+func (store *RedisStore) AddTags(key string, tags []string, expire time.Duration) error {
+	ctx := context.TODO()
+	_, err := store.RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, tag := range tags {
+			addTagScript.Eval(ctx, pipe, []string{TagKey(tag)}, key, expire.Milliseconds())
+		}
+		return nil
+	})
+	return err
+}
+
+// InvalidateTags remove all keys attached to tags, and the tag sets
+func (store *RedisStore) InvalidateTags(tags ...string) error {
+	ctx := context.TODO()
+	for _, tag := range tags {
+		tagKey := TagKey(tag)
+		keys, err := store.RedisClient.SMembers(ctx, tagKey).Result()
+		if err != nil {
+			return err
+		}
+		if err := store.del(ctx, append(keys, tagKey)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeletePrefix remove all keys start with prefix, every master is scanned in cluster
+func (store *RedisStore) DeletePrefix(prefix string) error {
+	ctx := context.TODO()
+	return store.scan(ctx, prefix, func(keys []string) error {
+		return store.del(ctx, keys)
+	})
+}
+
+// GetMulti get keys in redis by a single MGET, or by pipelined GET in cluster and ring,
+// where the keys may live on different nodes
+func (store *RedisStore) GetMulti(keys []string, values []interface{}) []error {
+	ctx := context.TODO()
+	errs := make([]error, len(keys))
+	if len(keys) == 0 {
+		return errs
+	}
+
+	if _, ok := store.RedisClient.(*redis.Client); ok {
+		results, err := store.RedisClient.MGet(ctx, keys...).Result()
+		for i := range keys {
+			switch {
+			case err != nil:
+				errs[i] = err
+			case results[i] == nil:
+				errs[i] = persist.ErrCacheMiss
+			default:
+				s, _ := results[i].(string)
+				errs[i] = redis.NewStringResult(s, nil).Scan(values[i])
+			}
+		}
+		return errs
+	}
+
+	cmds := make([]*redis.StringCmd, len(keys))
+	// the error of every command is checked below, including the ones failed to be sent
+	_, _ = store.RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Get(ctx, key)
+		}
+		return nil
+	})
+	for i, cmd := range cmds {
+		if errs[i] = cmd.Scan(values[i]); errs[i] == redis.Nil {
+			errs[i] = persist.ErrCacheMiss
+		}
+	}
+	return errs
+}
+
+// SetMulti put key value pairs to redis in a pipeline, and expire after expire
+func (store *RedisStore) SetMulti(keys []string, values []interface{}, expire time.Duration) error {
+	if len(keys) != len(values) {
+		return persist.ErrMultiLength
+	}
+	ctx := context.TODO()
+	_, err := store.RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			pipe.Set(ctx, key, values[i], expire)
+		}
+		return nil
+	})
+	return err
+}
+
+// DeleteMulti remove keys in redis, grouped by slot in cluster, the missing ones are skipped
+func (store *RedisStore) DeleteMulti(keys ...string) error {
+	return store.del(context.TODO(), keys)
+}
+
+// Exists report whether key exists in redis
+func (store *RedisStore) Exists(key string) (bool, error) {
+	ctx := context.TODO()
+	n, err := store.RedisClient.Exists(ctx, key).Result()
+	return n > 0, err
+}
+
+// TTL return the remaining ttl of key in redis, NoExpiration if it never expires
+func (store *RedisStore) TTL(key string) (time.Duration, error) {
+	ctx := context.TODO()
+	ttl, err := store.RedisClient.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	// go-redis keeps the negative replies as they are, -2 for a missing key and -1 for no expiration
+	switch ttl {
+	case -2:
+		return 0, persist.ErrCacheMiss
+	case -1:
+		return persist.NoExpiration, nil
+	}
+	return ttl, nil
+}
+
+// Touch set key to expire after expire in redis, a non-positive one means never expire
+func (store *RedisStore) Touch(key string, expire time.Duration) error {
+	ctx := context.TODO()
+	if expire <= 0 {
+		// PERSIST reports false for a key without expiration too, so check the existence
+		pipe := store.RedisClient.TxPipeline()
+		exists := pipe.Exists(ctx, key)
+		pipe.Persist(ctx, key)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+		if exists.Val() == 0 {
+			return persist.ErrCacheMiss
+		}
+		return nil
+	}
+
+	ok, err := store.RedisClient.PExpire(ctx, key, expire).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return persist.ErrCacheMiss
+	}
+	return nil
+}
+
+// Clear remove the keys start with KeyPrefix, the tag sets and the locks by SCAN, every master
+// is scanned in cluster. the other keys are kept, as the redis may be shared.
+func (store *RedisStore) Clear() error {
+	ctx := context.TODO()
+	for _, prefix := range store.clearPrefixes() {
+		err := store.scan(ctx, prefix, func(keys []string) error {
+			return store.del(ctx, keys)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearPrefixes return the prefixes of the keys removed by Clear, without the ones covered by another
+func (store *RedisStore) clearPrefixes() []string {
+	keyPrefix := store.KeyPrefix
+	if keyPrefix == "" {
+		keyPrefix = DefaultKeyPrefix
+	}
+	prefixes := []string{keyPrefix}
+	for _, prefix := range []string{TagKeyPrefix, LockKeyPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, keyPrefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// Keys return all keys start with prefix in redis by SCAN, every master is scanned in cluster
+func (store *RedisStore) Keys(prefix string) ([]string, error) {
+	ctx := context.TODO()
+	var keys []string
+	err := store.scan(ctx, prefix, func(batch []string) error {
+		keys = append(keys, batch...)
+		return nil
+	})
+	return keys, err
+}
+
+// scan call fn with the batches of the keys start with prefix on every node
+func (store *RedisStore) scan(ctx context.Context, prefix string, fn func(keys []string) error) error {
+	return store.forEachNode(ctx, func(ctx context.Context, node redis.UniversalClient) error {
+		iter := node.Scan(ctx, 0, escapePattern(prefix)+"*", scanCount).Iterator()
+
+		keys := make([]string, 0, scanCount)
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+			if len(keys) == scanCount {
+				if err := fn(keys); err != nil {
+					return err
+				}
+				keys = keys[:0]
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		return fn(keys)
+	})
+}
+
+// TagKey return the key of the tag index set. the tag is wrapped as a hash tag, so the slot
+// of the set depends on the tag only, and the page keys can join the slot of their tag
+// by HashTag, which makes deleting them a single command in cluster.
+func TagKey(tag string) string {
+	return TagKeyPrefix + HashTag(tag)
+}
+
+// HashTag wrap s in braces, the keys containing the same hash tag are in the same cluster slot
+func HashTag(s string) string {
+	return "{" + s + "}"
+}
+
+// del remove the keys in as few commands as the client allows. multi-key commands must not
+// cross slots in cluster, so the keys are grouped by slot, and a ring may place every key
+// on a different shard, so each of them is deleted on its own.
+func (store *RedisStore) del(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	switch store.RedisClient.(type) {
+	case *redis.Client:
+		return store.RedisClient.Del(ctx, keys...).Err()
+	case *redis.ClusterClient:
+		slots := make(map[int][]string)
+		for _, key := range keys {
+			slot := KeySlot(key)
+			slots[slot] = append(slots[slot], key)
+		}
+		_, err := store.RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, slotKeys := range slots {
+				pipe.Del(ctx, slotKeys...)
+			}
+			return nil
+		})
+		return err
+	default:
+		_, err := store.RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range keys {
+				pipe.Del(ctx, key)
+			}
+			return nil
+		})
+		return err
+	}
+}
+
+// forEachNode run fn on every master of cluster or every shard of ring, or on the client itself
+func (store *RedisStore) forEachNode(ctx context.Context, fn func(ctx context.Context, node redis.UniversalClient) error) error {
+	switch client := store.RedisClient.(type) {
+	case *redis.ClusterClient:
+		return client.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return fn(ctx, node)
+		})
+	case *redis.Ring:
+		return client.ForEachShard(ctx, func(ctx context.Context, node *redis.Client) error {
+			return fn(ctx, node)
+		})
+	default:
+		return fn(ctx, client)
+	}
+}
+
+// escapePattern escape the glob-style special characters of redis MATCH pattern
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
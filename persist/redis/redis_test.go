@@ -4,25 +4,46 @@ import (
 	"context"
 	"github.com/wyy-go/wcache/persist"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
 	"github.com/go-redis/redis/v8"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
-// These tests require redis server running on localhost:6379 (the default)
-const redisTestServer = "127.0.0.1:6379"
-
+// These tests run against miniredis, an in-process stand-in of redis server
 var newRedisStore = func(t *testing.T, defaultExpiration time.Duration) persist.CacheStore {
+	store, _ := newMiniRedisStore(t)
+	return store
+}
+
+func newMiniRedisStore(t *testing.T) (*RedisStore, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
 	client := redis.NewClient(&redis.Options{
-		Addr:     redisTestServer,
-		DB:       10,
-		Password: "",
+		Addr: mr.Addr(),
+	})
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		panic(err)
+	}
+	return NewRedisStore(client), mr
+}
+
+func newMiniRedisClusterStore(t *testing.T) (*RedisStore, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs: []string{mr.Addr()},
 	})
 
 	if err := client.Ping(context.Background()).Err(); err != nil {
 		panic(err)
 	}
-	return NewRedisStore(client)
+	return NewRedisStore(client), mr
 }
 
 func TestRedisCache_TypicalGetSet(t *testing.T) {
@@ -47,14 +68,14 @@ func TestRedisCache_TypicalGetSet(t *testing.T) {
 func TestRedisCache_Expiration(t *testing.T) {
 	// memcached does not support expiration times less than 1 second.
 	var err error
-	cache := newRedisStore(t, time.Second)
+	cache, mr := newMiniRedisStore(t)
 	value := 10
 
 	// Test Set w/ short time
 	if err := cache.Set("int", value, time.Second); err != nil {
 		t.Errorf("wrong to set cache, but got: %s", err)
 	}
-	time.Sleep(2 * time.Second)
+	mr.FastForward(2 * time.Second)
 	err = cache.Get("int", &value)
 	if err != persist.ErrCacheMiss {
 		t.Errorf("Expected CacheMiss, but got: %s", err)
@@ -64,7 +85,7 @@ func TestRedisCache_Expiration(t *testing.T) {
 	if err := cache.Set("int", value, time.Hour); err != nil {
 		t.Errorf("wrong to set cache, but got: %s", err)
 	}
-	time.Sleep(2 * time.Second)
+	mr.FastForward(2 * time.Second)
 	err = cache.Get("int", &value)
 	if err != nil {
 		t.Errorf("Expected to get the value, but got: %s", err)
@@ -74,7 +95,7 @@ func TestRedisCache_Expiration(t *testing.T) {
 	if err := cache.Set("int", value, 0); err != nil {
 		t.Errorf("wrong to set cache, but got: %s", err)
 	}
-	time.Sleep(2 * time.Second)
+	mr.FastForward(2 * time.Second)
 	err = cache.Get("int", &value)
 	if err != nil {
 		t.Errorf("Expected to get the value, but got: %s", err)
@@ -93,8 +114,554 @@ func TestRedisCache_EmptyCache(t *testing.T) {
 		t.Errorf("Expected ErrCacheMiss for non-existent key: %s", err)
 	}
 
+	// redis does nothing if the key doesn't exist, as the CacheStore contract says
 	err = cache.Delete("notexist")
-	if err != persist.ErrCacheMiss {
-		t.Errorf("Expected ErrCacheMiss for non-existent key: %s", err)
+	if err != nil {
+		t.Errorf("Expected nil for non-existent key: %s", err)
+	}
+}
+
+func TestRedisCache_Tags(t *testing.T) {
+	cache := newRedisStore(t, time.Hour).(persist.TagStore)
+	store := cache.(persist.CacheStore)
+
+	for _, key := range []string{"tag1", "tag2", "tag3"} {
+		if err := store.Set(key, key, time.Hour); err != nil {
+			t.Errorf("wrong to set cache, but got: %s", err)
+		}
+	}
+	if err := cache.AddTags("tag1", []string{"a", "b"}, time.Hour); err != nil {
+		t.Errorf("wrong to add tags, but got: %s", err)
+	}
+	if err := cache.AddTags("tag2", []string{"b"}, time.Hour); err != nil {
+		t.Errorf("wrong to add tags, but got: %s", err)
+	}
+
+	if err := cache.InvalidateTags("b"); err != nil {
+		t.Errorf("wrong to invalidate tags, but got: %s", err)
+	}
+	var value string
+	for _, key := range []string{"tag1", "tag2"} {
+		if err := store.Get(key, &value); err != persist.ErrCacheMiss {
+			t.Errorf("Expected CacheMiss, but got: %s", err)
+		}
+	}
+	if err := store.Get("tag3", &value); err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+}
+
+func TestRedisCache_DeletePrefix(t *testing.T) {
+	cache := newRedisStore(t, time.Hour)
+
+	for _, key := range []string{"prefix:1", "prefix:2", "other:1"} {
+		if err := cache.Set(key, key, time.Hour); err != nil {
+			t.Errorf("wrong to set cache, but got: %s", err)
+		}
+	}
+	if err := cache.(persist.PrefixDeleter).DeletePrefix("prefix:"); err != nil {
+		t.Errorf("wrong to delete prefix, but got: %s", err)
+	}
+
+	var value string
+	for _, key := range []string{"prefix:1", "prefix:2"} {
+		if err := cache.Get(key, &value); err != persist.ErrCacheMiss {
+			t.Errorf("Expected CacheMiss, but got: %s", err)
+		}
+	}
+	if err := cache.Get("other:1", &value); err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+}
+
+func TestRedisCache_Cluster(t *testing.T) {
+	cache, _ := newMiniRedisClusterStore(t)
+
+	keys := []string{"page:1", "page:2", "page:3", "other:1"}
+	for _, key := range keys {
+		if err := cache.Set(key, key, time.Hour); err != nil {
+			t.Errorf("wrong to set cache, but got: %s", err)
+		}
+	}
+	if err := cache.AddTags("page:1", []string{"a"}, time.Hour); err != nil {
+		t.Errorf("wrong to add tags, but got: %s", err)
+	}
+	if err := cache.AddTags("other:1", []string{"a"}, time.Hour); err != nil {
+		t.Errorf("wrong to add tags, but got: %s", err)
+	}
+
+	if err := cache.InvalidateTags("a"); err != nil {
+		t.Errorf("wrong to invalidate tags, but got: %s", err)
+	}
+	if err := cache.DeletePrefix("page:"); err != nil {
+		t.Errorf("wrong to delete prefix, but got: %s", err)
+	}
+
+	var value string
+	for _, key := range keys {
+		if err := cache.Get(key, &value); err != persist.ErrCacheMiss {
+			t.Errorf("Expected CacheMiss for %s, but got: %v", key, err)
+		}
+	}
+}
+
+func TestRedisCache_TagExpiration(t *testing.T) {
+	cache, mr := newMiniRedisStore(t)
+
+	if err := cache.AddTags("k1", []string{"a"}, time.Hour); err != nil {
+		t.Errorf("wrong to add tags, but got: %s", err)
+	}
+	if err := cache.AddTags("k2", []string{"a"}, time.Minute); err != nil {
+		t.Errorf("wrong to add tags, but got: %s", err)
+	}
+	if ttl := mr.TTL(TagKey("a")); ttl != time.Hour {
+		t.Errorf("Expected the tag lives as long as the keys, but got: %s", ttl)
+	}
+	if err := cache.AddTags("k3", []string{"a"}, 0); err != nil {
+		t.Errorf("wrong to add tags, but got: %s", err)
+	}
+	if ttl := mr.TTL(TagKey("a")); ttl != 0 {
+		t.Errorf("Expected the tag never expires, but got: %s", ttl)
+	}
+}
+
+func TestRedisCache_Capabilities(t *testing.T) {
+	for name, newStore := range map[string]func(t *testing.T) (*RedisStore, *miniredis.Miniredis){
+		"single":  newMiniRedisStore,
+		"cluster": newMiniRedisClusterStore,
+	} {
+		t.Run(name, func(t *testing.T) {
+			cache, mr := newStore(t)
+			for _, key := range []string{"prefix:1", "prefix:2", "other:1"} {
+				if err := cache.Set(key, key, time.Hour); err != nil {
+					t.Errorf("wrong to set cache, but got: %s", err)
+				}
+			}
+
+			if ok, err := cache.Exists("prefix:1"); err != nil || !ok {
+				t.Errorf("Expected prefix:1 exists, got %v, %v", ok, err)
+			}
+			if ok, err := cache.Exists("notexist"); err != nil || ok {
+				t.Errorf("Expected notexist not exists, got %v, %v", ok, err)
+			}
+
+			if ttl, err := cache.TTL("prefix:1"); err != nil || ttl != time.Hour {
+				t.Errorf("Expected the ttl of an hour, got %s, %v", ttl, err)
+			}
+			if _, err := cache.TTL("notexist"); err != persist.ErrCacheMiss {
+				t.Errorf("Expected CacheMiss, but got: %v", err)
+			}
+
+			if err := cache.Touch("prefix:1", 2*time.Hour); err != nil {
+				t.Errorf("wrong to touch, but got: %s", err)
+			}
+			if ttl := mr.TTL("prefix:1"); ttl != 2*time.Hour {
+				t.Errorf("Expected the ttl of two hours, got %s", ttl)
+			}
+			if err := cache.Touch("prefix:2", 0); err != nil {
+				t.Errorf("wrong to touch, but got: %s", err)
+			}
+			if ttl, err := cache.TTL("prefix:2"); err != nil || ttl != persist.NoExpiration {
+				t.Errorf("Expected no expiration, got %s, %v", ttl, err)
+			}
+			for _, expire := range []time.Duration{time.Hour, 0} {
+				if err := cache.Touch("notexist", expire); err != persist.ErrCacheMiss {
+					t.Errorf("Expected CacheMiss, but got: %v", err)
+				}
+			}
+
+			keys, err := cache.Keys("prefix:")
+			sort.Strings(keys)
+			if err != nil || !reflect.DeepEqual(keys, []string{"prefix:1", "prefix:2"}) {
+				t.Errorf("Expected the keys with prefix, got %v, %v", keys, err)
+			}
+
+			// only the keys of the cache are cleared, the redis may be shared
+			if err := cache.Set(DefaultKeyPrefix+"page:1", "page", time.Hour); err != nil {
+				t.Errorf("wrong to set cache, but got: %s", err)
+			}
+			if err := cache.AddTags(DefaultKeyPrefix+"page:1", []string{"tag"}, time.Hour); err != nil {
+				t.Errorf("wrong to add tags, but got: %s", err)
+			}
+			if _, err := cache.TryLock(DefaultKeyPrefix+"page:1", time.Minute); err != nil {
+				t.Errorf("wrong to lock, but got: %s", err)
+			}
+			LockKeyPrefix = "lock:"
+			defer func() { LockKeyPrefix = "wcache.lock:" }()
+			if _, err := cache.TryLock(DefaultKeyPrefix+"page:2", time.Minute); err != nil {
+				t.Errorf("wrong to lock, but got: %s", err)
+			}
+
+			if err := cache.Clear(); err != nil {
+				t.Errorf("wrong to clear, but got: %s", err)
+			}
+			keys, err = cache.Keys("")
+			sort.Strings(keys)
+			if err != nil || !reflect.DeepEqual(keys, []string{"other:1", "prefix:1", "prefix:2"}) {
+				t.Errorf("Expected the other keys kept after clear, got %v, %v", keys, err)
+			}
+		})
+	}
+}
+
+func TestRedisCache_Multi(t *testing.T) {
+	for name, newStore := range map[string]func(t *testing.T) (*RedisStore, *miniredis.Miniredis){
+		"single":  newMiniRedisStore,
+		"cluster": newMiniRedisClusterStore,
+	} {
+		t.Run(name, func(t *testing.T) {
+			cache, mr := newStore(t)
+			keys := []string{"k1", "k2", "k3"}
+			if err := cache.SetMulti(keys[:2], []interface{}{"v1", "v2"}, time.Hour); err != nil {
+				t.Errorf("wrong to set multi, but got: %s", err)
+			}
+			if ttl := mr.TTL("k2"); ttl != time.Hour {
+				t.Errorf("Expected the ttl of an hour, got %s", ttl)
+			}
+
+			values := make([]string, len(keys))
+			errs := cache.GetMulti(keys, []interface{}{&values[0], &values[1], &values[2]})
+			if errs[0] != nil || errs[1] != nil || errs[2] != persist.ErrCacheMiss {
+				t.Errorf("Expected k1 and k2 found and k3 missed, got %v", errs)
+			}
+			if values[0] != "v1" || values[1] != "v2" {
+				t.Errorf("Expected to get v1 and v2 back, got %v", values)
+			}
+
+			if err := cache.DeleteMulti(keys...); err != nil {
+				t.Errorf("wrong to delete multi, but got: %s", err)
+			}
+			for i, err := range cache.GetMulti(keys, []interface{}{&values[0], &values[1], &values[2]}) {
+				if err != persist.ErrCacheMiss {
+					t.Errorf("Expected CacheMiss of %s, but got: %v", keys[i], err)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisCache_Lock(t *testing.T) {
+	for name, newStore := range map[string]func(t *testing.T) (*RedisStore, *miniredis.Miniredis){
+		"single":  newMiniRedisStore,
+		"cluster": newMiniRedisClusterStore,
+	} {
+		t.Run(name, func(t *testing.T) {
+			cache, mr := newStore(t)
+
+			first, err := cache.TryLock("key", time.Second)
+			if err != nil {
+				t.Fatalf("wrong to lock, but got: %s", err)
+			}
+			if _, err := cache.TryLock("key", time.Second); err != persist.ErrLocked {
+				t.Errorf("Expected ErrLocked, but got: %v", err)
+			}
+			if _, err := cache.TryLock("other", time.Second); err != nil {
+				t.Errorf("wrong to lock another key, but got: %s", err)
+			}
+
+			// the expired lease can not release the lock acquired by another
+			mr.FastForward(2 * time.Second)
+			second, err := cache.TryLock("key", time.Second)
+			if err != nil {
+				t.Fatalf("wrong to lock after expiration, but got: %s", err)
+			}
+			if second.Fence() <= first.Fence() {
+				t.Errorf("Expected the fence increases, got %d after %d", second.Fence(), first.Fence())
+			}
+			if err := first.Release(); err != nil {
+				t.Errorf("wrong to release, but got: %s", err)
+			}
+			if _, err := cache.TryLock("key", time.Second); err != persist.ErrLocked {
+				t.Errorf("Expected ErrLocked, but got: %v", err)
+			}
+
+			if err := second.Release(); err != nil {
+				t.Errorf("wrong to release, but got: %s", err)
+			}
+			third, err := cache.TryLock("key", time.Second)
+			if err != nil {
+				t.Fatalf("wrong to lock after release, but got: %s", err)
+			}
+			if third.Fence() <= second.Fence() {
+				t.Errorf("Expected the fence increases, got %d after %d", third.Fence(), second.Fence())
+			}
+
+			// only the latest holder can write
+			if err := cache.SetFenced("key", "third", time.Hour, third.Fence()); err != nil {
+				t.Errorf("wrong to set fenced, but got: %s", err)
+			}
+			if ttl := mr.TTL("key"); ttl != time.Hour {
+				t.Errorf("Expected the ttl of an hour, got %s", ttl)
+			}
+			if err := cache.SetFenced("key", "second", time.Hour, second.Fence()); err != persist.ErrLockLost {
+				t.Errorf("Expected ErrLockLost, but got: %v", err)
+			}
+			if err := cache.SetFenced("never-locked", "value", time.Hour, 1); err != persist.ErrLockLost {
+				t.Errorf("Expected ErrLockLost, but got: %v", err)
+			}
+			var value string
+			if err := cache.Get("key", &value); err != nil || value != "third" {
+				t.Errorf("Expected to get third back, got %s, %v", value, err)
+			}
+		})
+	}
+}
+
+func TestLockKeys(t *testing.T) {
+	for _, key := range []string{"page", "{user1}:page", "a{b", "a{}b", "ab}c", "wcache.page.cache:\x7b\x01\x7d"} {
+		lockKey, fenceKey, colocated := lockKeys(key)
+		if KeySlot(lockKey) != KeySlot(fenceKey) {
+			t.Errorf("Expected the lock and fence of %q in the same slot", key)
+		}
+		if colocated != (KeySlot(lockKey) == KeySlot(key)) {
+			t.Errorf("Expected colocated %v of %q", colocated, key)
+		}
+	}
+	if _, _, colocated := lockKeys("{user1}:page"); !colocated {
+		t.Errorf("Expected the lock colocated with the hash tag")
+	}
+	if _, _, colocated := lockKeys("ab}c"); colocated {
+		t.Errorf("Expected the lock can not be colocated")
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	tests := map[string]int{
+		"foo":                  12182,
+		"somekey":              11058,
+		"{user1000}.following": KeySlot("user1000"),
+		"{}foo":                KeySlot("{}foo"),
+		TagKey("user1000"):     KeySlot("user1000"),
+	}
+	for key, want := range tests {
+		if got := KeySlot(key); got != want {
+			t.Errorf("Expected slot %d of %s, but got: %d", want, key, got)
+		}
+	}
+}
+
+func TestTrackingStore_Keyspace(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store, err := NewTrackingStore(&redis.Options{Addr: mr.Addr()}, TrackingOptions{
+		Mode:     TrackingKeyspace,
+		Prefixes: []string{"page:"},
+	})
+	if err != nil {
+		t.Fatalf("wrong to create tracking store, but got: %s", err)
+	}
+	defer store.Close()
+
+	for _, key := range []string{"page:1", "other:1"} {
+		if err := store.Set(key, "foo", time.Hour); err != nil {
+			t.Errorf("wrong to set cache, but got: %s", err)
+		}
+	}
+
+	var value string
+	for _, key := range []string{"page:1", "other:1"} {
+		if err := store.Get(key, &value); err != nil || value != "foo" {
+			t.Errorf("Expected to get foo back, got %s, %v", value, err)
+		}
+	}
+
+	// changed behind the store without notification, the local copy is served
+	_ = mr.Set("page:1", "bar")
+	_ = mr.Set("other:1", "bar")
+	if err := store.Get("page:1", &value); err != nil || value != "foo" {
+		t.Errorf("Expected to get the local copy foo back, got %s, %v", value, err)
+	}
+	if err := store.Get("other:1", &value); err != nil || value != "bar" {
+		t.Errorf("Expected untracked key bar back, got %s, %v", value, err)
+	}
+
+	mr.Publish("__keyspace@0__:page:1", "set")
+	deadline := time.Now().Add(time.Second)
+	for {
+		if err := store.Get("page:1", &value); err == nil && value == "bar" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the local copy to be invalidated, got %s", value)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := store.Delete("page:1"); err != nil {
+		t.Errorf("wrong to delete cache, but got: %s", err)
+	}
+	if err := store.Get("page:1", &value); err != persist.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss, but got: %v", err)
+	}
+}
+
+// trackingStandIn register a CLIENT command on miniredis, which has no client tracking, and
+// record the CLIENT TRACKING of the connections with the CLIENT ID of them
+type trackingStandIn struct {
+	mu       sync.Mutex
+	ids      map[*server.Peer]int
+	tracking [][]string
+}
+
+func newTrackingStandIn(t *testing.T, mr *miniredis.Miniredis) *trackingStandIn {
+	s := &trackingStandIn{ids: make(map[*server.Peer]int)}
+	err := mr.Server().Register("CLIENT", func(c *server.Peer, cmd string, args []string) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		id, ok := s.ids[c]
+		if !ok {
+			id = len(s.ids) + 1
+			s.ids[c] = id
+		}
+		switch {
+		case len(args) == 1 && strings.EqualFold(args[0], "ID"):
+			c.WriteInt(id)
+		case len(args) > 1 && strings.EqualFold(args[0], "TRACKING"):
+			s.tracking = append(s.tracking, append([]string{strconv.Itoa(id)}, args[1:]...))
+			c.WriteOK()
+		default:
+			c.WriteError("ERR unknown subcommand")
+		}
+	})
+	if err != nil {
+		t.Fatalf("wrong to register CLIENT, but got: %s", err)
+	}
+	return s
+}
+
+func TestTrackingStore_Broadcast(t *testing.T) {
+	mr := miniredis.RunT(t)
+	standIn := newTrackingStandIn(t, mr)
+	store, err := NewTrackingStore(&redis.Options{Addr: mr.Addr()}, TrackingOptions{Prefixes: []string{"page:"}})
+	if err != nil {
+		t.Fatalf("wrong to create tracking store, but got: %s", err)
+	}
+	defer store.Close()
+
+	// the subscriber redirects the invalidations of the prefixes to itself
+	standIn.mu.Lock()
+	tracking := standIn.tracking
+	standIn.mu.Unlock()
+	if len(tracking) != 1 {
+		t.Fatalf("Expected CLIENT TRACKING once, but got: %v", tracking)
+	}
+	want := []string{tracking[0][0], "ON", "REDIRECT", tracking[0][0], "BCAST", "PREFIX", "page:"}
+	if !reflect.DeepEqual(tracking[0], want) {
+		t.Errorf("Expected CLIENT TRACKING %v, but got: %v", want, tracking[0])
+	}
+
+	if err := store.Set("page:1", "foo", time.Hour); err != nil {
+		t.Errorf("wrong to set cache, but got: %s", err)
+	}
+	var value string
+	if err := store.Get("page:1", &value); err != nil || value != "foo" {
+		t.Errorf("Expected to get foo back, got %s, %v", value, err)
+	}
+	_ = mr.Set("page:1", "bar")
+	if err := store.Get("page:1", &value); err != nil || value != "foo" {
+		t.Errorf("Expected to get the local copy foo back, got %s, %v", value, err)
+	}
+
+	// redis publishes the changed keys to the redirected connection in RESP2
+	mr.Publish(invalidateChannel, "page:1")
+	deadline := time.Now().Add(time.Second)
+	for {
+		if err := store.Get("page:1", &value); err == nil && value == "bar" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the local copy to be invalidated, got %s", value)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTrackingStore_Writes(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store, err := NewTrackingStore(&redis.Options{Addr: mr.Addr()}, TrackingOptions{Mode: TrackingKeyspace})
+	if err != nil {
+		t.Fatalf("wrong to create tracking store, but got: %s", err)
+	}
+	defer store.Close()
+
+	// keep a local copy of key, then delete it behind the store without notification
+	cached := func(key string) {
+		var value string
+		if err := store.Set(key, "foo", time.Hour); err != nil {
+			t.Errorf("wrong to set cache, but got: %s", err)
+		}
+		if err := store.Get(key, &value); err != nil || value != "foo" {
+			t.Errorf("Expected to get foo back, got %s, %v", value, err)
+		}
+		mr.Del(key)
+	}
+
+	for name, write := range map[string]func(key string) error{
+		"DeleteMulti": func(key string) error { return store.DeleteMulti(key) },
+		"DeletePrefix": func(key string) error {
+			return store.DeletePrefix(key[:3])
+		},
+		"InvalidateTags": func(key string) error {
+			if err := store.AddTags(key, []string{"tag"}, time.Hour); err != nil {
+				return err
+			}
+			return store.InvalidateTags("tag")
+		},
+		"Clear": func(key string) error { return store.Clear() },
+	} {
+		key := "wcache.page:" + name
+		cached(key)
+		if err := write(key); err != nil {
+			t.Errorf("wrong to %s, but got: %s", name, err)
+		}
+		var value string
+		if err := store.Get(key, &value); err != persist.ErrCacheMiss {
+			t.Errorf("Expected CacheMiss after %s, got %s, %v", name, value, err)
+		}
+	}
+
+	for name, write := range map[string]func(key string) error{
+		"SetMulti": func(key string) error {
+			return store.SetMulti([]string{key}, []interface{}{"bar"}, time.Hour)
+		},
+		"SetFenced": func(key string) error {
+			lease, err := store.TryLock(key, time.Minute)
+			if err != nil {
+				return err
+			}
+			defer lease.Release()
+			return store.SetFenced(key, "bar", time.Hour, lease.Fence())
+		},
+	} {
+		key := "wcache.page:" + name
+		cached(key)
+		if err := write(key); err != nil {
+			t.Errorf("wrong to %s, but got: %s", name, err)
+		}
+		var value string
+		if err := store.Get(key, &value); err != nil || value != "bar" {
+			t.Errorf("Expected to get bar back after %s, got %s, %v", name, value, err)
+		}
+	}
+}
+
+func TestTrackingStore_HandleMessage(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store, err := NewTrackingStore(&redis.Options{Addr: mr.Addr()}, TrackingOptions{Mode: TrackingKeyspace})
+	if err != nil {
+		t.Fatalf("wrong to create tracking store, but got: %s", err)
+	}
+	defer store.Close()
+
+	for _, key := range []string{"k1", "k2", "k3"} {
+		_ = store.local.Set(key, key)
+	}
+
+	store.handleMessage(&redis.Message{Channel: invalidateChannel, PayloadSlice: []string{"k1", "k2"}})
+	if store.local.Count() != 1 {
+		t.Errorf("Expected k1 and k2 invalidated, but got %v", store.local.GetKeys())
+	}
+	store.handleMessage(&redis.Message{Channel: invalidateChannel})
+	if store.local.Count() != 0 {
+		t.Errorf("Expected flushed, but got %v", store.local.GetKeys())
 	}
 }
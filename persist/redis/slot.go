@@ -0,0 +1,37 @@
+package redis
+
+import "strings"
+
+// slotCount the number of hash slots in redis cluster
+const slotCount = 16384
+
+// KeySlot return the cluster hash slot of the key, only the hash tag is hashed if any
+func KeySlot(key string) int {
+	return int(crc16(hashedPart(key)) % slotCount)
+}
+
+// hashedPart return the part of key hashed by cluster and ring, the hash tag if any, or the whole key
+func hashedPart(key string) string {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
+
+// crc16 the CRC16-CCITT (XModem) checksum used by redis cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
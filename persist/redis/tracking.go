@@ -0,0 +1,319 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ReneKroon/ttlcache/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/wyy-go/wcache/persist"
+)
+
+// TrackingMode decide how the local copies of TrackingStore are invalidated
+type TrackingMode int
+
+const (
+	// TrackingBroadcast use CLIENT TRACKING in broadcast mode, it requires redis 6 or later
+	TrackingBroadcast TrackingMode = iota
+	// TrackingKeyspace use keyspace notifications, it is the fallback for older servers,
+	// notify-keyspace-events must be configured with K and the events of the changes,
+	// e.g. "Kg$x" for generic, string and expired events
+	TrackingKeyspace
+)
+
+// invalidateChannel the channel of CLIENT TRACKING invalidation messages in RESP2
+const invalidateChannel = "__redis__:invalidate"
+
+// TrackingOptions the options of TrackingStore
+type TrackingOptions struct {
+	// Mode how the local copies are invalidated, default is TrackingBroadcast
+	Mode TrackingMode
+	// Prefixes the key prefixes kept locally, default is all keys
+	Prefixes []string
+	// LocalSize the max number of local copies, default is 10000
+	LocalSize int
+	// LocalTTL the max duration of a local copy, which bounds the staleness in case an
+	// invalidation message is lost, default is 1 minute
+	LocalTTL time.Duration
+}
+
+// TrackingStore a RedisStore keeping local copies of the recently read keys, which are
+// dropped as soon as redis reports them changed, so most reads of hot keys stay local
+// while consistent. it works with a single node, the cluster is not supported.
+type TrackingStore struct {
+	*RedisStore
+
+	options  TrackingOptions
+	local    *ttlcache.Cache
+	client   *redis.Client
+	sub      *redis.Client
+	pubsub   *redis.PubSub
+	channels []string
+
+	// seq increase on every invalidation, a read from redis is kept locally
+	// only if no invalidation happens during it
+	seq    uint64
+	closed int32
+	wg     sync.WaitGroup
+}
+
+var _ persist.CacheStore = (*TrackingStore)(nil)
+
+// NewTrackingStore create a TrackingStore with the options of redis client, a dedicated
+// connection is subscribed to the invalidation messages. it fails if the server does not
+// support the mode, e.g. CLIENT TRACKING before redis 6.
+func NewTrackingStore(opt *redis.Options, tracking TrackingOptions) (*TrackingStore, error) {
+	if len(tracking.Prefixes) == 0 {
+		tracking.Prefixes = []string{""}
+	}
+	if tracking.LocalSize <= 0 {
+		tracking.LocalSize = 10000
+	}
+	if tracking.LocalTTL <= 0 {
+		tracking.LocalTTL = time.Minute
+	}
+
+	local := ttlcache.NewCache()
+	local.SkipTTLExtensionOnHit(true)
+	local.SetCacheSizeLimit(tracking.LocalSize)
+
+	client := redis.NewClient(opt)
+	s := &TrackingStore{
+		RedisStore: NewRedisStore(client),
+		options:    tracking,
+		local:      local,
+		client:     client,
+	}
+
+	subOpt := *opt
+	subOpt.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		if opt.OnConnect != nil {
+			if err := opt.OnConnect(ctx, cn); err != nil {
+				return err
+			}
+		}
+		// the invalidations may have been lost while reconnecting
+		s.flushLocal()
+		if tracking.Mode != TrackingBroadcast {
+			return nil
+		}
+
+		// redirect the invalidations to the connection itself, it subscribes to them then
+		id, err := cn.ClientID(ctx).Result()
+		if err != nil {
+			return err
+		}
+		args := []interface{}{"CLIENT", "TRACKING", "ON", "REDIRECT", id, "BCAST"}
+		for _, prefix := range tracking.Prefixes {
+			if prefix != "" {
+				args = append(args, "PREFIX", prefix)
+			}
+		}
+		cmd := redis.NewCmd(ctx, args...)
+		_ = cn.Process(ctx, cmd)
+		return cmd.Err()
+	}
+	s.sub = redis.NewClient(&subOpt)
+
+	ctx := context.Background()
+	if tracking.Mode == TrackingBroadcast {
+		s.channels = []string{invalidateChannel}
+		s.pubsub = s.sub.Subscribe(ctx, invalidateChannel)
+	} else {
+		for _, prefix := range tracking.Prefixes {
+			s.channels = append(s.channels, keyspaceChannel(opt.DB, escapePattern(prefix)+"*"))
+		}
+		s.pubsub = s.sub.PSubscribe(ctx, s.channels...)
+	}
+	if _, err := s.pubsub.Receive(ctx); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.receive()
+	return s, nil
+}
+
+// Get get key from the local copy, or from redis and keep a local copy
+func (s *TrackingStore) Get(key string, value interface{}) error {
+	if data, err := s.local.Get(key); err == nil {
+		return redis.NewStringResult(data.(string), nil).Scan(value)
+	}
+
+	ctx := context.TODO()
+	seq := atomic.LoadUint64(&s.seq)
+	data, err := s.client.Get(ctx, key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return persist.ErrCacheMiss
+		}
+		return err
+	}
+
+	if s.tracked(key) && atomic.LoadUint64(&s.seq) == seq {
+		_ = s.local.SetWithTTL(key, data, s.options.LocalTTL)
+	}
+	return redis.NewStringResult(data, nil).Scan(value)
+}
+
+// Set put key value pair to redis, and drop the local copy
+func (s *TrackingStore) Set(key string, value interface{}, expire time.Duration) error {
+	defer s.invalidate(key)
+	return s.RedisStore.Set(key, value, expire)
+}
+
+// Delete remove key in redis, and drop the local copy
+func (s *TrackingStore) Delete(key string) error {
+	defer s.invalidate(key)
+	return s.RedisStore.Delete(key)
+}
+
+// SetMulti put key value pairs to redis, and drop the local copies
+func (s *TrackingStore) SetMulti(keys []string, values []interface{}, expire time.Duration) error {
+	defer s.invalidate(keys...)
+	return s.RedisStore.SetMulti(keys, values, expire)
+}
+
+// SetFenced put key value pair to redis if the fence is current, and drop the local copy
+func (s *TrackingStore) SetFenced(key string, value interface{}, expire time.Duration, fence int64) error {
+	defer s.invalidate(key)
+	return s.RedisStore.SetFenced(key, value, expire, fence)
+}
+
+// DeleteMulti remove keys in redis, and drop the local copies
+func (s *TrackingStore) DeleteMulti(keys ...string) error {
+	defer s.invalidate(keys...)
+	return s.RedisStore.DeleteMulti(keys...)
+}
+
+// DeletePrefix remove all keys start with prefix in redis, and drop the local copies of them
+func (s *TrackingStore) DeletePrefix(prefix string) error {
+	defer s.invalidatePrefix(prefix)
+	return s.RedisStore.DeletePrefix(prefix)
+}
+
+// InvalidateTags remove all keys attached to tags in redis, and drop all local copies,
+// as the keys of the tags are known by redis only
+func (s *TrackingStore) InvalidateTags(tags ...string) error {
+	defer s.flushLocal()
+	return s.RedisStore.InvalidateTags(tags...)
+}
+
+// Clear remove all keys of the store in redis, and drop all local copies
+func (s *TrackingStore) Clear() error {
+	defer s.flushLocal()
+	return s.RedisStore.Clear()
+}
+
+// Close stop receiving the invalidations, and close the redis clients
+func (s *TrackingStore) Close() error {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return nil
+	}
+
+	var errs []string
+	if s.pubsub != nil {
+		if err := s.pubsub.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	s.wg.Wait()
+	for _, c := range []*redis.Client{s.sub, s.client} {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	_ = s.local.Close()
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// receive handle the invalidation messages until closed
+func (s *TrackingStore) receive() {
+	defer s.wg.Done()
+
+	ctx := context.Background()
+	for atomic.LoadInt32(&s.closed) == 0 {
+		msg, err := s.pubsub.Receive(ctx)
+		if err != nil {
+			if atomic.LoadInt32(&s.closed) != 0 {
+				return
+			}
+			// e.g. the null payload of a flush can not be parsed, be conservative
+			s.flushLocal()
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		if m, ok := msg.(*redis.Message); ok {
+			s.handleMessage(m)
+		}
+	}
+}
+
+// handleMessage drop the local copies of the keys in the message
+func (s *TrackingStore) handleMessage(m *redis.Message) {
+	if m.Channel == invalidateChannel {
+		if m.Payload == "" && len(m.PayloadSlice) == 0 {
+			s.flushLocal()
+			return
+		}
+		if m.Payload != "" {
+			s.invalidate(m.Payload)
+		}
+		for _, key := range m.PayloadSlice {
+			s.invalidate(key)
+		}
+		return
+	}
+
+	if i := strings.IndexByte(m.Channel, ':'); i >= 0 && strings.HasPrefix(m.Channel, "__keyspace@") {
+		s.invalidate(m.Channel[i+1:])
+	}
+}
+
+func (s *TrackingStore) invalidate(keys ...string) {
+	atomic.AddUint64(&s.seq, 1)
+	for _, key := range keys {
+		_ = s.local.Remove(key)
+	}
+}
+
+func (s *TrackingStore) invalidatePrefix(prefix string) {
+	atomic.AddUint64(&s.seq, 1)
+	for _, key := range s.local.GetKeys() {
+		if strings.HasPrefix(key, prefix) {
+			_ = s.local.Remove(key)
+		}
+	}
+}
+
+func (s *TrackingStore) flushLocal() {
+	atomic.AddUint64(&s.seq, 1)
+	if s.local != nil {
+		_ = s.local.Purge()
+	}
+}
+
+// tracked report whether the key is under the tracked prefixes
+func (s *TrackingStore) tracked(key string) bool {
+	for _, prefix := range s.options.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func keyspaceChannel(db int, pattern string) string {
+	return "__keyspace@" + strconv.Itoa(db) + "__:" + pattern
+}
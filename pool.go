@@ -2,7 +2,9 @@ package wcache
 
 import (
 	"encoding"
+	"errors"
 	"github.com/gin-gonic/gin"
+	"github.com/wyy-go/wcache/persist"
 	"net/http"
 	"sync"
 )
@@ -32,8 +34,14 @@ func (p *cachePool) Get() *ResponseCache {
 
 // Put implement Pool interface
 func (p *cachePool) Put(c *ResponseCache) {
+	if c.shared {
+		// never decode into the data shared with a store
+		c.Data = nil
+		c.shared = false
+	}
 	c.Data = c.Data[:0]
 	c.Header = make(http.Header)
+	c.Variants = nil
 	c.encode = nil
 	p.pool.Put(c)
 }
@@ -42,40 +50,99 @@ type ResponseCache struct {
 	Status int
 	Header http.Header
 	Data   []byte
-	encode Encoding
+	// Variants the body compressed by the other compressors, keyed by content-coding
+	Variants map[string][]byte
+	encode   Encoding
+	// shared the data is shared with the value in a store by CopyFrom
+	shared bool
 }
 
 var _ encoding.BinaryMarshaler = (*ResponseCache)(nil)
 var _ encoding.BinaryUnmarshaler = (*ResponseCache)(nil)
+var _ persist.BodySplitter = (*ResponseCache)(nil)
+var _ persist.Copier = (*ResponseCache)(nil)
 
+// MarshalBinary encode by the Encoding, and frame it with the schema version and a checksum
 func (c *ResponseCache) MarshalBinary() ([]byte, error) {
-	return c.encode.Marshal(c)
+	payload, err := c.encode.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return marshalFrame(payload, ResponseCacheVersion), nil
 }
 
+// UnmarshalBinary verify the frame, upgrade the older schema versions and decode by the Encoding.
+// any failure is an ErrCorrupt, except an unknown future schema version is an ErrUnknownVersion,
+// and the data encrypted by a key not in the keyring is an ErrDecrypt.
 func (c *ResponseCache) UnmarshalBinary(data []byte) error {
-	return c.encode.Unmarshal(data, c)
+	payload, version, err := unmarshalFrame(data)
+	if err != nil {
+		return err
+	}
+	if payload, err = upgradePayload(payload, version, c.encode); err != nil {
+		return err
+	}
+	if err := c.encode.Unmarshal(payload, c); err != nil {
+		// written by an instance with a newer keyring during a key rollout, leave it as it is
+		if errors.Is(err, ErrDecrypt) && unknownKey(c.encode, payload) {
+			return err
+		}
+		return &corruptError{err}
+	}
+	return nil
+}
+
+// CopyFrom set c to src if it is a *ResponseCache, the memory stores use it instead of reflection
+func (c *ResponseCache) CopyFrom(src interface{}) bool {
+	s, ok := src.(*ResponseCache)
+	if ok {
+		*c = *s
+		c.shared = true
+	}
+	return ok
+}
+
+// SplitBody encode the response without the body, so that the body can be stored as is
+func (c *ResponseCache) SplitBody() ([]byte, []byte, error) {
+	head := *c
+	head.Data = nil
+	data, err := head.MarshalBinary()
+	return data, c.Data, err
+}
+
+// JoinBody decode the response encoded by SplitBody, and set the body
+func (c *ResponseCache) JoinBody(head []byte, body []byte) error {
+	if err := c.UnmarshalBinary(head); err != nil {
+		return err
+	}
+	c.Data = body
+	return nil
 }
 
 func getCacheFromWriter(cacheWriter *responseCacheWriter, encode Encoding) *ResponseCache {
+	// capped, so appending to the cached data never writes into the buffer of the writer
+	data := cacheWriter.body.Bytes()
 	return &ResponseCache{
-		cacheWriter.Status(),
-		cacheWriter.Header().Clone(),
-		cacheWriter.body.Bytes(),
-		encode,
+		Status: cacheWriter.Status(),
+		Header: cacheWriter.Header().Clone(),
+		Data:   data[:len(data):len(data)],
+		encode: encode,
 	}
 }
 
 func responseWithCache(c *gin.Context, options *Options, respCache *ResponseCache) {
+	// headers must be in place before the status line is written
+	replayHeader(c.Writer.Header(), respCache.Header, options.headerPolicy)
+	data := negotiateBody(c, options, respCache)
 	c.Writer.WriteHeader(respCache.Status)
 
-	for key, values := range respCache.Header {
-		for _, val := range values {
-			c.Writer.Header().Set(key, val)
+	// HEAD request share the GET entry, but must not carry a body
+	if c.Request.Method != http.MethodHead {
+		if _, err := c.Writer.Write(data); err != nil {
+			options.logger.Errorf("write response error: %s", err)
 		}
-	}
-
-	if _, err := c.Writer.Write(respCache.Data); err != nil {
-		options.logger.Errorf("write response error: %s", err)
+	} else {
+		c.Writer.WriteHeaderNow()
 	}
 
 	// abort handler chain and return directly
@@ -0,0 +1,221 @@
+package wcache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wyy-go/wcache/persist"
+)
+
+// RefreshAhead configure re-rendering the popular entries in background before they expire,
+// so that the hot pages never miss. a hit of a key with at least MinHits hits in the current
+// window, in the last Fraction of its ttl, triggers one re-render through the singleflight.
+// the expire time is known for the entries set by this process, and asked by persist.TTLer
+// for the others, the entries of a store without it are refreshed only after set here.
+type RefreshAhead struct {
+	// Fraction the last fraction of the expire in which a hit triggers the refresh, default is 0.1
+	Fraction float64
+	// MinHits the hits within Window for a key to be popular, default is 10
+	MinHits int
+	// Window the period in which the hits are counted, default is the expire
+	Window time.Duration
+	// MaxConcurrent the max refreshes at the same time, the others are skipped, default is 4
+	MaxConcurrent int
+}
+
+// refresher count the hits and track the expire time of keys for RefreshAhead
+type refresher struct {
+	config RefreshAhead
+	sem    chan struct{}
+
+	mu          sync.Mutex
+	windowStart time.Time
+	hits        map[string]int
+	// expireAt the expire time of keys, the zero time means never expire
+	expireAt   map[string]time.Time
+	refreshing map[string]struct{}
+}
+
+func newRefresher(config RefreshAhead, expire time.Duration) *refresher {
+	if config.Fraction <= 0 || config.Fraction >= 1 {
+		config.Fraction = 0.1
+	}
+	if config.MinHits <= 0 {
+		config.MinHits = 10
+	}
+	if config.Window <= 0 {
+		config.Window = expire
+	}
+	if config.MaxConcurrent <= 0 {
+		config.MaxConcurrent = 4
+	}
+	return &refresher{
+		config:      config,
+		sem:         make(chan struct{}, config.MaxConcurrent),
+		windowStart: time.Now(),
+		hits:        make(map[string]int),
+		expireAt:    make(map[string]time.Time),
+		refreshing:  make(map[string]struct{}),
+	}
+}
+
+// setExpire record the expire time of key after it is set
+func (r *refresher) setExpire(key string, expire time.Duration) {
+	var expireAt time.Time
+	if expire > 0 {
+		expireAt = time.Now().Add(expire)
+	}
+
+	r.mu.Lock()
+	r.expireAt[key] = expireAt
+	r.mu.Unlock()
+}
+
+// hit count a hit of key, and report whether it should be refreshed now, the caller must
+// call done after the refresh then
+func (r *refresher) hit(options *Options, key string) bool {
+	now := time.Now()
+	r.mu.Lock()
+	if now.Sub(r.windowStart) >= r.config.Window {
+		r.rollWindow(now)
+	}
+	r.hits[key]++
+	_, refreshing := r.refreshing[key]
+	if refreshing || r.hits[key] < r.config.MinHits {
+		r.mu.Unlock()
+		return false
+	}
+	expireAt, ok := r.expireAt[key]
+	r.mu.Unlock()
+
+	if !ok {
+		ttler, ok := options.store.(persist.TTLer)
+		if !ok {
+			return false
+		}
+		ttl, err := ttler.TTL(key)
+		if err != nil {
+			if !errors.Is(err, persist.ErrCacheMiss) {
+				options.logger.Errorf("get cache ttl error: %s, cache key: %s", err, key)
+			}
+			return false
+		}
+		if ttl > 0 {
+			expireAt = now.Add(ttl)
+		}
+		r.mu.Lock()
+		r.expireAt[key] = expireAt
+		r.mu.Unlock()
+	}
+	if expireAt.IsZero() || expireAt.Sub(now) > time.Duration(r.config.Fraction*float64(options.expire)) {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.refreshing[key]; ok {
+		return false
+	}
+	select {
+	case r.sem <- struct{}{}:
+	default:
+		return false
+	}
+	r.refreshing[key] = struct{}{}
+	return true
+}
+
+// done release the refresh of key
+func (r *refresher) done(key string) {
+	r.mu.Lock()
+	delete(r.refreshing, key)
+	r.mu.Unlock()
+	<-r.sem
+}
+
+// rollWindow reset the hits, and drop the expire time of the expired keys, the caller must hold mu
+func (r *refresher) rollWindow(now time.Time) {
+	r.windowStart = now
+	r.hits = make(map[string]int, len(r.hits))
+	for key, expireAt := range r.expireAt {
+		if !expireAt.IsZero() && !expireAt.After(now) {
+			delete(r.expireAt, key)
+		}
+	}
+}
+
+// refreshCache re-render the response of the request in background, on a new context with
+// the params and keys of it, and a context.Background request, as the request is done before
+// the refresh. gin.Context.Copy is not used, as the copy is marked aborted.
+func refreshCache(c *gin.Context, options *Options, cacheKey string) {
+	cp, _ := gin.CreateTestContext(&refreshWriter{discardWriter: discardWriter{header: make(http.Header)}})
+	cp.Request = c.Request.Clone(context.Background())
+	cp.Params = append(cp.Params, c.Params...)
+	if c.Keys != nil {
+		cp.Keys = make(map[string]interface{}, len(c.Keys))
+		for k, v := range c.Keys {
+			cp.Keys[k] = v
+		}
+	}
+
+	go func() {
+		defer options.refresher.done(cacheKey)
+		defer func() {
+			if r := recover(); r != nil {
+				options.logger.Errorf("refresh cache panic: %v, cache key: %s", r, cacheKey)
+			}
+		}()
+
+		_, _, _ = options.group.Do(cacheKey, func() (interface{}, error) {
+			// skip the refresh if another instance is refreshing it
+			if respCache, _ := renderLocked(cp, options, cacheKey, false); respCache != nil {
+				return respCache, nil
+			}
+			return nil, nil
+		})
+	}()
+}
+
+// refreshWriter a gin.ResponseWriter of the background refresh, which discards the response
+type refreshWriter struct {
+	discardWriter
+	size int
+}
+
+var _ gin.ResponseWriter = (*refreshWriter)(nil)
+
+func (w *refreshWriter) Write(b []byte) (int, error) {
+	w.size += len(b)
+	return w.discardWriter.Write(b)
+}
+
+func (w *refreshWriter) WriteString(s string) (int, error) { return w.Write([]byte(s)) }
+
+func (w *refreshWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *refreshWriter) Size() int { return w.size }
+
+func (w *refreshWriter) Written() bool { return w.status != 0 }
+
+func (w *refreshWriter) WriteHeaderNow() { w.WriteHeader(w.Status()) }
+
+func (w *refreshWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("wcache: refresh response can not be hijacked")
+}
+
+func (w *refreshWriter) Flush() {}
+
+func (w *refreshWriter) CloseNotify() <-chan bool { return nil }
+
+func (w *refreshWriter) Pusher() http.Pusher { return nil }
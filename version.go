@@ -0,0 +1,69 @@
+package wcache
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/wyy-go/wcache/persist"
+)
+
+// ResponseCacheVersion the schema version of ResponseCache, bump it and register an
+// Upgrader from the previous version whenever the encoded form of ResponseCache changes.
+// version 0 is the data written before the schema version was introduced.
+const ResponseCacheVersion uint8 = 1
+
+// ErrUnknownVersion the cached data is written by a newer release with an unknown schema
+// version. it is a persist.ErrCacheMiss, but not an ErrCorrupt, so the key is not deleted,
+// see UnknownVersionPolicy.
+var ErrUnknownVersion = fmt.Errorf("wcache: unknown cache schema version: %w", persist.ErrCacheMiss)
+
+// Upgrader upgrade the payload encoded by encode from a schema version to the next one
+type Upgrader func(payload []byte, encode Encoding) ([]byte, error)
+
+// UnknownVersionPolicy decide what to do with the data of an unknown future schema version,
+// which happens when old and new releases share a store during a rolling deploy.
+type UnknownVersionPolicy int
+
+const (
+	// UnknownVersionMiss treat it as a miss, the response is rendered and overwrites it
+	UnknownVersionMiss UnknownVersionPolicy = iota
+	// UnknownVersionBypass treat it as a miss, but leave it for the newer release
+	UnknownVersionBypass
+)
+
+var (
+	upgradersMu sync.RWMutex
+	upgraders   = map[uint8]Upgrader{
+		// the legacy data without frame has the same schema as version 1
+		0: func(payload []byte, _ Encoding) ([]byte, error) { return payload, nil },
+	}
+)
+
+// RegisterUpgrader register the Upgrader from the schema version to the next one,
+// it replaces the registered one if any.
+func RegisterUpgrader(from uint8, upgrader Upgrader) {
+	upgradersMu.Lock()
+	defer upgradersMu.Unlock()
+	upgraders[from] = upgrader
+}
+
+// upgradePayload upgrade the payload to ResponseCacheVersion step by step
+func upgradePayload(payload []byte, version uint8, encode Encoding) ([]byte, error) {
+	if version > ResponseCacheVersion {
+		return nil, ErrUnknownVersion
+	}
+
+	upgradersMu.RLock()
+	defer upgradersMu.RUnlock()
+	for ; version < ResponseCacheVersion; version++ {
+		upgrader, ok := upgraders[version]
+		if !ok {
+			return nil, &corruptError{fmt.Errorf("no upgrader from schema version %d", version)}
+		}
+		var err error
+		if payload, err = upgrader(payload, encode); err != nil {
+			return nil, &corruptError{fmt.Errorf("upgrade from schema version %d: %w", version, err)}
+		}
+	}
+	return payload, nil
+}
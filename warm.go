@@ -0,0 +1,236 @@
+package wcache
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultWarmConcurrency the default number of requests a Warmer replays at the same time
+const DefaultWarmConcurrency = 4
+
+// Warmer replay synthetic GET requests through a handler, e.g. a *gin.Engine, so that the Cache
+// middleware fills the store before the real users hit the cold pages after a deploy or purge
+type Warmer struct {
+	handler http.Handler
+	options WarmerOptions
+}
+
+// WarmerOptions contains all options of Warmer
+type WarmerOptions struct {
+	concurrency int
+	rate        int
+	host        string
+	header      http.Header
+}
+
+// WarmerOption represents the optional function of Warmer
+type WarmerOption func(o *WarmerOptions)
+
+// WithWarmConcurrency set the number of requests replayed at the same time, default is DefaultWarmConcurrency
+func WithWarmConcurrency(n int) WarmerOption {
+	return func(o *WarmerOptions) {
+		if n > 0 {
+			o.concurrency = n
+		}
+	}
+}
+
+// WithWarmRate limit the requests replayed per second, default is unlimited
+func WithWarmRate(perSecond int) WarmerOption {
+	return func(o *WarmerOptions) {
+		o.rate = perSecond
+	}
+}
+
+// WithWarmHost set the Host of the requests whose uri is not absolute
+func WithWarmHost(host string) WarmerOption {
+	return func(o *WarmerOptions) {
+		o.host = host
+	}
+}
+
+// WithWarmHeader add a header to every request, e.g. the Accept-Encoding to fill the compressed variants
+func WithWarmHeader(key, value string) WarmerOption {
+	return func(o *WarmerOptions) {
+		o.header.Add(key, value)
+	}
+}
+
+// WarmFailure a request failed to warm
+type WarmFailure struct {
+	URI string
+	// Status the status code of the response, 0 if the request was not replayed
+	Status int
+	Err    error
+}
+
+// WarmReport the result of a warmup
+type WarmReport struct {
+	Total     int
+	Succeeded int
+	Failures  []WarmFailure
+	Duration  time.Duration
+}
+
+// NewWarmer create a Warmer which replays the requests through handler
+func NewWarmer(handler http.Handler, opts ...WarmerOption) *Warmer {
+	options := WarmerOptions{
+		concurrency: DefaultWarmConcurrency,
+		header:      make(http.Header),
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return &Warmer{handler: handler, options: options}
+}
+
+// Warm replay a GET request of every uri, a path with query or an absolute url, and report the
+// ones which failed or did not answer 2xx. the uris not replayed when ctx is done are failures too.
+func (w *Warmer) Warm(ctx context.Context, uris []string) *WarmReport {
+	start := time.Now()
+	report := &WarmReport{Total: len(uris)}
+
+	var mu sync.Mutex
+	record := func(f *WarmFailure) {
+		mu.Lock()
+		defer mu.Unlock()
+		if f == nil {
+			report.Succeeded++
+		} else {
+			report.Failures = append(report.Failures, *f)
+		}
+	}
+
+	var tick <-chan time.Time
+	if w.options.rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(w.options.rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < w.options.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for uri := range jobs {
+				record(w.replay(ctx, uri))
+			}
+		}()
+	}
+
+	for i, uri := range uris {
+		if tick != nil && i > 0 {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			for _, uri := range uris[i:] {
+				record(&WarmFailure{URI: uri, Err: ctx.Err()})
+			}
+			break
+		}
+		jobs <- uri
+	}
+	close(jobs)
+	wg.Wait()
+
+	report.Duration = time.Since(start)
+	return report
+}
+
+// WarmSitemap replay the pages listed in the sitemap XML read from r, see Warm
+func (w *Warmer) WarmSitemap(ctx context.Context, r io.Reader) (*WarmReport, error) {
+	uris, err := ParseSitemap(r)
+	if err != nil {
+		return nil, err
+	}
+	return w.Warm(ctx, uris), nil
+}
+
+// ParseSitemap return the locations of the pages in a sitemap XML, the <loc> of every <url> in <urlset>
+func ParseSitemap(r io.Reader) ([]string, error) {
+	var sitemap struct {
+		XMLName xml.Name `xml:"urlset"`
+		URLs    []struct {
+			Loc string `xml:"loc"`
+		} `xml:"url"`
+	}
+	if err := xml.NewDecoder(r).Decode(&sitemap); err != nil {
+		return nil, fmt.Errorf("wcache: parse sitemap error: %w", err)
+	}
+
+	uris := make([]string, 0, len(sitemap.URLs))
+	for _, u := range sitemap.URLs {
+		if u.Loc != "" {
+			uris = append(uris, u.Loc)
+		}
+	}
+	return uris, nil
+}
+
+// replay serve a GET request of uri by the handler, return nil if it answered 2xx
+func (w *Warmer) replay(ctx context.Context, uri string) (failure *WarmFailure) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return &WarmFailure{URI: uri, Err: err}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return &WarmFailure{URI: uri, Err: err}
+	}
+	// the server sets RequestURI of the incoming requests, which the cache keys are generated by
+	req.RequestURI = u.RequestURI()
+	if u.Host == "" {
+		req.Host = w.options.host
+	}
+	for key, values := range w.options.header {
+		req.Header[key] = append([]string(nil), values...)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			failure = &WarmFailure{URI: uri, Err: fmt.Errorf("wcache: warm panic: %v", r)}
+		}
+	}()
+
+	writer := &discardWriter{header: make(http.Header)}
+	w.handler.ServeHTTP(writer, req)
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+	if writer.status < 200 || writer.status >= 300 {
+		return &WarmFailure{URI: uri, Status: writer.status, Err: fmt.Errorf("wcache: warm status %d", writer.status)}
+	}
+	return nil
+}
+
+// discardWriter a http.ResponseWriter which records the status and discards the body
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardWriter) Header() http.Header { return w.header }
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (w *discardWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
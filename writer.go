@@ -1,22 +1,103 @@
 package wcache
 
 import (
+	"bufio"
 	"bytes"
 	"github.com/gin-gonic/gin"
+	"net"
+	"net/http"
+	"strings"
 )
 
 // responseCacheWriter
 type responseCacheWriter struct {
 	gin.ResponseWriter
 	body bytes.Buffer
+
+	// maxBodySize the limit of the recorded body, 0 means no limit
+	maxBodySize int64
+	// uncacheable the response stops being recorded and must not be cached,
+	// because it is too large, streaming or the connection has been hijacked
+	uncacheable bool
 }
 
 func (w *responseCacheWriter) Write(b []byte) (int, error) {
-	w.body.Write(b)
+	if w.record(len(b)) {
+		w.body.Write(b)
+	}
 	return w.ResponseWriter.Write(b)
 }
 
 func (w *responseCacheWriter) WriteString(s string) (int, error) {
-	w.body.WriteString(s)
+	if w.record(len(s)) {
+		w.body.WriteString(s)
+	}
 	return w.ResponseWriter.WriteString(s)
 }
+
+// WriteHeader implement http.ResponseWriter interface
+func (w *responseCacheWriter) WriteHeader(code int) {
+	w.detectStream()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// WriteHeaderNow implement gin.ResponseWriter interface
+func (w *responseCacheWriter) WriteHeaderNow() {
+	w.detectStream()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+// Flush implement http.Flusher interface, a flushed response is streaming and will not be cached
+func (w *responseCacheWriter) Flush() {
+	w.disableCache()
+	w.ResponseWriter.Flush()
+}
+
+// Hijack implement http.Hijacker interface, a hijacked connection will not be cached
+func (w *responseCacheWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.disableCache()
+	return w.ResponseWriter.Hijack()
+}
+
+// CloseNotify implement http.CloseNotifier interface
+func (w *responseCacheWriter) CloseNotify() <-chan bool {
+	return w.ResponseWriter.CloseNotify()
+}
+
+// Pusher implement gin.ResponseWriter interface
+func (w *responseCacheWriter) Pusher() http.Pusher {
+	return w.ResponseWriter.Pusher()
+}
+
+// cacheable report whether the response has been fully recorded and is not streaming
+func (w *responseCacheWriter) cacheable() bool {
+	w.detectStream()
+	return !w.uncacheable
+}
+
+// detectStream disable the cache for server-sent events
+func (w *responseCacheWriter) detectStream() {
+	if !w.uncacheable && strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		w.disableCache()
+	}
+}
+
+// record report whether the next n bytes should be recorded,
+// the response becomes uncacheable once the body exceeds the limit
+func (w *responseCacheWriter) record(n int) bool {
+	w.detectStream()
+	if w.uncacheable {
+		return false
+	}
+	if w.maxBodySize > 0 && int64(w.body.Len()+n) > w.maxBodySize {
+		w.disableCache()
+		return false
+	}
+	return true
+}
+
+// disableCache stop recording and release the recorded body
+func (w *responseCacheWriter) disableCache() {
+	w.uncacheable = true
+	w.body = bytes.Buffer{}
+}